@@ -9,3 +9,260 @@ CREATE TABLE IF NOT EXISTS users (
   password_hash VARCHAR(255) NOT NULL,
   username VARCHAR(50) NULL UNIQUE
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+-- Queue of commands issued to plants. Replaces the old in-memory map so
+-- queued commands survive a restart.
+CREATE TABLE IF NOT EXISTS plant_commands (
+  command_id BIGINT NOT NULL PRIMARY KEY AUTO_INCREMENT,
+  plant_id VARCHAR(100) NOT NULL,
+  command TEXT NOT NULL,
+  status VARCHAR(20) NOT NULL DEFAULT 'queued', -- queued, delivered, acknowledged, expired
+  created_at DATETIME NOT NULL,
+  delivered_at DATETIME NULL,
+  INDEX idx_plant_commands_plant_status (plant_id, status)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+-- Command acknowledgement and redelivery.
+ALTER TABLE plant_commands
+  ADD COLUMN ack_deadline DATETIME NULL,
+  ADD COLUMN delivery_count INT NOT NULL DEFAULT 0,
+  ADD COLUMN acknowledged_at DATETIME NULL,
+  ADD COLUMN success TINYINT(1) NULL,
+  ADD COLUMN result_message VARCHAR(500) NULL;
+
+-- Scheduled and recurring commands. See scheduler.go for how `expression`
+-- is interpreted for each kind.
+CREATE TABLE IF NOT EXISTS plant_schedules (
+  schedule_id BIGINT NOT NULL PRIMARY KEY AUTO_INCREMENT,
+  plant_id VARCHAR(100) NOT NULL,
+  command TEXT NOT NULL,
+  kind VARCHAR(20) NOT NULL, -- cron, interval, once
+  expression VARCHAR(100) NOT NULL,
+  time_zone VARCHAR(64) NOT NULL DEFAULT 'UTC',
+  paused TINYINT(1) NOT NULL DEFAULT 0,
+  next_run_at DATETIME NULL,
+  last_run_at DATETIME NULL,
+  created_at DATETIME NOT NULL,
+  INDEX idx_plant_schedules_plant (plant_id),
+  INDEX idx_plant_schedules_next_run (next_run_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+-- Admins can manage server-wide settings such as sensor types.
+ALTER TABLE users ADD COLUMN is_admin TINYINT(1) NOT NULL DEFAULT 0;
+
+-- Registry of the kinds of readings plants can log.
+CREATE TABLE IF NOT EXISTS sensor_types (
+  type_name VARCHAR(50) NOT NULL PRIMARY KEY,
+  display_name VARCHAR(100) NOT NULL,
+  unit VARCHAR(20) NOT NULL DEFAULT '',
+  min_value DOUBLE NULL,
+  max_value DOUBLE NULL,
+  value_precision INT NOT NULL DEFAULT 2
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+INSERT IGNORE INTO sensor_types (type_name, display_name, unit, min_value, max_value, value_precision) VALUES
+  ('light', 'Light Intensity', 'lux', 0, NULL, 0),
+  ('temp', 'Temperature', '°C', -40, 85, 1),
+  ('moisture', 'Soil Moisture', '%', 0, 100, 1);
+
+-- Readings are always looked up by plant and time range.
+CREATE INDEX idx_plant_logs_plant_time ON plant_logs (plant_id, log_time);
+
+-- Rollups of plant_logs, written by the retention job in retention.go.
+CREATE TABLE IF NOT EXISTS plant_logs_hourly (
+  plant_id VARCHAR(100) NOT NULL,
+  log_type VARCHAR(50) NOT NULL,
+  bucket_start DATETIME NOT NULL,
+  min_value DOUBLE NOT NULL,
+  max_value DOUBLE NOT NULL,
+  sum_value DOUBLE NOT NULL,
+  value_count INT NOT NULL,
+  PRIMARY KEY (plant_id, log_type, bucket_start)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS plant_logs_daily (
+  plant_id VARCHAR(100) NOT NULL,
+  log_type VARCHAR(50) NOT NULL,
+  bucket_start DATETIME NOT NULL,
+  min_value DOUBLE NOT NULL,
+  max_value DOUBLE NOT NULL,
+  sum_value DOUBLE NOT NULL,
+  value_count INT NOT NULL,
+  PRIMARY KEY (plant_id, log_type, bucket_start)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+-- Threshold alerts on readings, evaluated in alerts.go as readings arrive.
+CREATE TABLE IF NOT EXISTS alert_rules (
+  rule_id BIGINT NOT NULL PRIMARY KEY AUTO_INCREMENT,
+  plant_id VARCHAR(100) NOT NULL,
+  log_type VARCHAR(50) NOT NULL,
+  comparison VARCHAR(10) NOT NULL, -- below, above
+  threshold DOUBLE NOT NULL,
+  duration VARCHAR(20) NOT NULL DEFAULT '0s',
+  hysteresis DOUBLE NOT NULL DEFAULT 0,
+  enabled TINYINT(1) NOT NULL DEFAULT 1,
+  state VARCHAR(10) NOT NULL DEFAULT 'ok', -- ok, pending, firing
+  breach_started_at DATETIME NULL,
+  last_fired_at DATETIME NULL,
+  last_cleared_at DATETIME NULL,
+  last_reading_at DATETIME NULL,
+  created_at DATETIME NOT NULL,
+  INDEX idx_alert_rules_plant_type (plant_id, log_type)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+-- When each plant was last heard from, and when its owner was last told it
+-- had gone offline. See presence.go.
+ALTER TABLE plants
+  ADD COLUMN last_seen_at DATETIME NULL,
+  ADD COLUMN offline_notified_at DATETIME NULL;
+
+-- Notifications waiting to be delivered, or already delivered, by the
+-- outbox worker in outbox.go.
+CREATE TABLE IF NOT EXISTS notification_outbox (
+  notification_id BIGINT NOT NULL PRIMARY KEY AUTO_INCREMENT,
+  user_id INT NOT NULL,
+  plant_id VARCHAR(100) NULL,
+  notification_type VARCHAR(50) NOT NULL,
+  recipient VARCHAR(255) NOT NULL,
+  subject VARCHAR(255) NOT NULL,
+  body TEXT NOT NULL,
+  status VARCHAR(20) NOT NULL DEFAULT 'pending', -- pending, sent, failed
+  attempts INT NOT NULL DEFAULT 0,
+  last_error VARCHAR(500) NULL,
+  next_attempt_at DATETIME NULL,
+  created_at DATETIME NOT NULL,
+  sent_at DATETIME NULL,
+  INDEX idx_notification_outbox_due (status, next_attempt_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+-- How each user wants to be notified. See notifiers.go. Users without a row
+-- get email.
+CREATE TABLE IF NOT EXISTS notification_preferences (
+  user_id INT NOT NULL PRIMARY KEY,
+  channel VARCHAR(20) NOT NULL DEFAULT 'email', -- email, webhook, push
+  webhook_url VARCHAR(500) NULL,
+  webhook_secret VARCHAR(255) NULL,
+  push_kind VARCHAR(20) NULL, -- ntfy, gotify
+  push_url VARCHAR(500) NULL,
+  push_token VARCHAR(255) NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+ALTER TABLE notification_outbox ADD COLUMN channel VARCHAR(20) NULL AFTER recipient;
+
+-- Notifications are rendered from per-type templates; see notifytypes.go.
+ALTER TABLE notification_outbox
+  ADD COLUMN severity VARCHAR(20) NOT NULL DEFAULT 'info' AFTER notification_type,
+  ADD COLUMN body_html MEDIUMTEXT NULL AFTER body;
+
+-- Which notifications each user wants. See NotificationPreferences in
+-- notifiers.go. Notifications filtered out by them are kept in the outbox
+-- with status 'suppressed' and the reason.
+ALTER TABLE notification_preferences
+  ADD COLUMN muted_types TEXT NULL, -- JSON array of notification types
+  ADD COLUMN quiet_start CHAR(5) NULL, -- HH:MM
+  ADD COLUMN quiet_end CHAR(5) NULL,
+  ADD COLUMN time_zone VARCHAR(64) NOT NULL DEFAULT 'UTC',
+  ADD COLUMN dedupe_window VARCHAR(20) NOT NULL DEFAULT '10m0s';
+
+ALTER TABLE notification_outbox
+  ADD COLUMN suppressed_reason VARCHAR(20) NULL AFTER status, -- muted, duplicate, quiet_hours
+  ADD INDEX idx_notification_outbox_dedupe (user_id, plant_id, notification_type, created_at);
+
+-- The outbox doubles as each user's notification history; see inbox.go.
+ALTER TABLE notification_outbox
+  ADD COLUMN read_at DATETIME NULL,
+  ADD INDEX idx_notification_outbox_user (user_id, notification_id);
+
+-- Server-side login sessions; see sessions.go. The cookie holds a random
+-- token and only its SHA-256 is stored. Existing cookies stop working.
+CREATE TABLE IF NOT EXISTS sessions (
+  session_id BIGINT NOT NULL PRIMARY KEY AUTO_INCREMENT,
+  token_hash CHAR(64) NOT NULL UNIQUE,
+  user_id INT NOT NULL,
+  user_agent VARCHAR(255) NULL,
+  ip VARCHAR(45) NULL,
+  created_at DATETIME NOT NULL,
+  last_used_at DATETIME NOT NULL,
+  expires_at DATETIME NOT NULL,
+  INDEX idx_sessions_user (user_id),
+  INDEX idx_sessions_expires (expires_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+-- Emailed password reset links; see passwordreset.go. Only the SHA-256 of
+-- each token is stored.
+CREATE TABLE IF NOT EXISTS password_reset_tokens (
+  token_hash CHAR(64) NOT NULL PRIMARY KEY,
+  user_id INT NOT NULL,
+  created_at DATETIME NOT NULL,
+  expires_at DATETIME NOT NULL,
+  used_at DATETIME NULL,
+  INDEX idx_password_reset_tokens_user (user_id, created_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+-- Email verification; see emailverify.go. Notifications aren't emailed to
+-- unverified addresses, but are kept in the outbox as suppressed with reason
+-- 'unverified_email'. Users who registered before verification existed have
+-- been getting email at their address all along, so they count as verified.
+ALTER TABLE users ADD COLUMN email_verified TINYINT(1) NOT NULL DEFAULT 0;
+UPDATE users SET email_verified = 1;
+
+CREATE TABLE IF NOT EXISTS email_verification_tokens (
+  token_hash CHAR(64) NOT NULL PRIMARY KEY,
+  user_id INT NOT NULL,
+  email VARCHAR(255) NOT NULL, -- the address the link was sent to
+  created_at DATETIME NOT NULL,
+  expires_at DATETIME NOT NULL,
+  used_at DATETIME NULL,
+  INDEX idx_email_verification_tokens_user (user_id, created_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+-- Failed logins in a row to an account from one IP, and the lockout they
+-- caused; see lockout.go.
+CREATE TABLE IF NOT EXISTS login_failures (
+  user_id INT NOT NULL,
+  ip VARCHAR(45) NOT NULL,
+  failures INT NOT NULL,
+  last_failure_at DATETIME NOT NULL,
+  locked_until DATETIME NULL,
+  PRIMARY KEY (user_id, ip),
+  INDEX idx_login_failures_last (last_failure_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+-- Optional TOTP second factor; see totp.go. totp_pending_secret holds a
+-- secret being enrolled until a code from it is confirmed. totp_last_step is
+-- the time step of the last code used, so a code can't be replayed.
+ALTER TABLE users
+  ADD COLUMN totp_secret VARCHAR(64) NULL,
+  ADD COLUMN totp_enabled TINYINT(1) NOT NULL DEFAULT 0,
+  ADD COLUMN totp_pending_secret VARCHAR(64) NULL,
+  ADD COLUMN totp_last_step BIGINT NULL;
+
+-- One-time recovery codes for users with TOTP; only their SHA-256 is stored.
+CREATE TABLE IF NOT EXISTS totp_recovery_codes (
+  code_id BIGINT NOT NULL PRIMARY KEY AUTO_INCREMENT,
+  user_id INT NOT NULL,
+  code_hash CHAR(64) NOT NULL,
+  used_at DATETIME NULL,
+  INDEX idx_totp_recovery_codes_user (user_id, code_hash)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+-- Compaction and log reads look up a plant's hourly summaries by time alone;
+-- see retention.go.
+CREATE INDEX idx_plant_logs_hourly_plant_time ON plant_logs_hourly (plant_id, bucket_start);
+
+-- Tokens for the TOTP step of a login; see totp.go. Only their SHA-256 is
+-- stored, and each allows a few attempts at the code.
+CREATE TABLE IF NOT EXISTS login_challenges (
+  token_hash CHAR(64) NOT NULL PRIMARY KEY,
+  user_id INT NOT NULL,
+  attempts INT NOT NULL,
+  expires_at DATETIME NOT NULL,
+  INDEX idx_login_challenges_expires (expires_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+-- Failed logins in a row to an account from any IP, and when its next login
+-- attempt may be checked while it is being throttled; see lockout.go.
+ALTER TABLE users
+  ADD COLUMN login_failures INT NOT NULL DEFAULT 0,
+  ADD COLUMN last_login_failure_at DATETIME NULL,
+  ADD COLUMN next_login_attempt_at DATETIME NULL;
@@ -0,0 +1,150 @@
+// `aggregate.go` contains the bucketing of plant readings into min/max/avg
+// summaries so long ranges don't send every raw row to the browser
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Bucket sizes a client may ask for, besides "raw" and "auto".
+var logBuckets = map[string]time.Duration{
+	"5m":  5 * time.Minute,
+	"15m": 15 * time.Minute,
+	"1h":  time.Hour,
+	"6h":  6 * time.Hour,
+	"1d":  24 * time.Hour,
+}
+
+// autoBucketOrder is tried smallest first when picking a bucket automatically.
+var autoBucketOrder = []string{"5m", "15m", "1h", "6h", "1d"}
+
+// Ranges up to rawRangeLimit are returned raw when the bucket is "auto";
+// longer ones use the smallest bucket giving at most maxAutoPoints points per
+// sensor type.
+const (
+	rawRangeLimit = 24 * time.Hour
+	maxAutoPoints = 600
+)
+
+// chooseLogBucket resolves the requested bucket name for a range. It returns 0
+// for raw readings.
+func chooseLogBucket(name string, start, end time.Time) (time.Duration, string, error) {
+	switch name {
+	case "raw":
+		return 0, "raw", nil
+	case "", "auto":
+		span := end.Sub(start)
+		if span <= rawRangeLimit {
+			return 0, "raw", nil
+		}
+		for _, b := range autoBucketOrder {
+			if span/logBuckets[b] <= maxAutoPoints {
+				return logBuckets[b], b, nil
+			}
+		}
+		last := autoBucketOrder[len(autoBucketOrder)-1]
+		return logBuckets[last], last, nil
+	}
+	d, ok := logBuckets[name]
+	if !ok {
+		return 0, "", fmt.Errorf("unknown bucket %q", name)
+	}
+	return d, name, nil
+}
+
+// logSample is a reading, or a summary of several readings, of one sensor type.
+type logSample struct {
+	LogType string
+	Time    time.Time
+	Min     float64
+	Max     float64
+	Sum     float64
+	Count   int
+}
+
+func rawLogSample(logType string, t time.Time, val float64) logSample {
+	return logSample{LogType: logType, Time: t, Min: val, Max: val, Sum: val, Count: 1}
+}
+
+// logAggregator collects samples into buckets of a fixed size, or passes them
+// through unchanged when the bucket size is 0.
+type logAggregator struct {
+	bucket  time.Duration
+	samples map[string]map[int64]*logSample
+	raw     map[string][]logSample
+}
+
+func newLogAggregator(bucket time.Duration) *logAggregator {
+	return &logAggregator{
+		bucket:  bucket,
+		samples: make(map[string]map[int64]*logSample),
+		raw:     make(map[string][]logSample),
+	}
+}
+
+func (a *logAggregator) add(s logSample) {
+	if a.bucket == 0 {
+		a.raw[s.LogType] = append(a.raw[s.LogType], s)
+		return
+	}
+	s.Time = s.Time.UTC().Truncate(a.bucket)
+	key := s.Time.UnixNano()
+	byTime := a.samples[s.LogType]
+	if byTime == nil {
+		byTime = make(map[int64]*logSample)
+		a.samples[s.LogType] = byTime
+	}
+	if cur, ok := byTime[key]; ok {
+		if s.Min < cur.Min {
+			cur.Min = s.Min
+		}
+		if s.Max > cur.Max {
+			cur.Max = s.Max
+		}
+		cur.Sum += s.Sum
+		cur.Count += s.Count
+		return
+	}
+	byTime[key] = &s
+}
+
+// result returns the per-type entries, newest first, with every registered
+// sensor type present. Values are rounded to each sensor's precision.
+func (a *logAggregator) result() map[string][]PlantLogEntry {
+	result := map[string][]PlantLogEntry{}
+	for _, t := range sensorTypes.all() {
+		result[t.Name] = make([]PlantLogEntry, 0)
+	}
+	for logType, byTime := range a.samples {
+		for _, s := range byTime {
+			result[logType] = append(result[logType], s.entry())
+		}
+	}
+	for logType, samples := range a.raw {
+		for _, s := range samples {
+			result[logType] = append(result[logType], s.entry())
+		}
+	}
+	for logType, entries := range result {
+		if _, ok := sensorTypes.get(logType); !ok {
+			delete(result, logType)
+			continue
+		}
+		sort.SliceStable(entries, func(i, j int) bool { return entries[i].Time.After(entries[j].Time) })
+	}
+	return result
+}
+
+// entry converts a sample to the response format. Samples covering more than
+// one reading carry min, max and count; single readings just the value.
+func (s logSample) entry() PlantLogEntry {
+	st, _ := sensorTypes.get(s.LogType)
+	e := PlantLogEntry{Val: st.round(s.Sum / float64(s.Count)), Time: s.Time}
+	if s.Count > 1 {
+		min, max := st.round(s.Min), st.round(s.Max)
+		e.Min, e.Max, e.Count = &min, &max, s.Count
+	}
+	return e
+}
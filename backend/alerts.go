@@ -0,0 +1,507 @@
+// `alerts.go` contains user-defined threshold alerts on sensor readings, their
+// evaluation as readings arrive, and the endpoints to manage them
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Comparisons an alert rule can make against its threshold.
+const (
+	alertBelow = "below"
+	alertAbove = "above"
+)
+
+// States of an alert rule. A rule is pending while its condition holds but
+// hasn't yet held for the rule's duration, and firing once it has.
+const (
+	alertOK      = "ok"
+	alertPending = "pending"
+	alertFiring  = "firing"
+)
+
+// maxAlertDuration bounds how long a condition may be required to hold.
+const maxAlertDuration = 7 * 24 * time.Hour
+
+// AlertRule is a single row of the alert_rules table.
+type AlertRule struct {
+	RuleID        int64      `json:"ruleId"`
+	PlantID       string     `json:"plantId"`
+	LogType       string     `json:"logType"`
+	Comparison    string     `json:"comparison"`
+	Threshold     float64    `json:"threshold"`
+	Duration      string     `json:"duration"`
+	Hysteresis    float64    `json:"hysteresis"`
+	Enabled       bool       `json:"enabled"`
+	State         string     `json:"state"`
+	BreachStarted *time.Time `json:"breachStartedAt,omitempty"`
+	LastFiredAt   *time.Time `json:"lastFiredAt,omitempty"`
+	LastClearedAt *time.Time `json:"lastClearedAt,omitempty"`
+	CreatedAt     time.Time  `json:"createdAt"`
+}
+
+// breached reports whether a value meets the rule's condition.
+func (a AlertRule) breached(v float64) bool {
+	if a.Comparison == alertBelow {
+		return v < a.Threshold
+	}
+	return v > a.Threshold
+}
+
+// recovered reports whether a value is far enough back on the right side of
+// the threshold for a firing rule to clear. The hysteresis margin stops a
+// value hovering around the threshold from firing the rule over and over.
+func (a AlertRule) recovered(v float64) bool {
+	if a.Comparison == alertBelow {
+		return v >= a.Threshold+a.Hysteresis
+	}
+	return v <= a.Threshold-a.Hysteresis
+}
+
+// alertTransition is what evaluating a reading against a rule changed.
+type alertTransition int
+
+const (
+	alertUnchanged alertTransition = iota
+	alertFired
+	alertCleared
+)
+
+// evaluateAlertRule works out a rule's next state given a reading taken at t.
+// It updates rule in place and reports whether the rule fired or cleared.
+func evaluateAlertRule(rule *AlertRule, v float64, t time.Time) alertTransition {
+	duration, _ := time.ParseDuration(rule.Duration)
+	switch rule.State {
+	case alertFiring:
+		if rule.recovered(v) {
+			rule.State = alertOK
+			rule.BreachStarted = nil
+			rule.LastClearedAt = &t
+			return alertCleared
+		}
+	default:
+		if !rule.breached(v) {
+			rule.State = alertOK
+			rule.BreachStarted = nil
+			return alertUnchanged
+		}
+		if rule.BreachStarted == nil {
+			rule.BreachStarted = &t
+		}
+		rule.State = alertPending
+		if t.Sub(*rule.BreachStarted) >= duration {
+			rule.State = alertFiring
+			rule.LastFiredAt = &t
+			return alertFired
+		}
+	}
+	return alertUnchanged
+}
+
+// evaluateAlerts checks a stored reading against the plant's enabled rules for
+// its type and emails the owner about any that fire. Readings older than the
+// last one a rule saw (e.g. from a batch upload of buffered readings) are
+// ignored by that rule, so its state always reflects the latest reading.
+// Errors are logged rather than returned, since the reading has already been
+// stored.
+func evaluateAlerts(plantID, logType string, value float64, logTime time.Time) {
+	fired, err := updateAlertRules(plantID, logType, value, logTime.UTC().Truncate(time.Second))
+	if err != nil {
+		log.Printf("alerts: evaluating rules for %s: %v", plantID, err)
+		return
+	}
+	for _, rule := range fired {
+		notifyAlert(rule, value)
+	}
+}
+
+// evaluateAlertsBatch evaluates a batch of stored readings in time order.
+func evaluateAlertsBatch(plantID string, entries []plantLogRow) {
+	sorted := make([]plantLogRow, len(entries))
+	copy(sorted, entries)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].LogTime.Before(sorted[j].LogTime) })
+	for _, e := range sorted {
+		evaluateAlerts(plantID, e.LogType, e.LogValue, e.LogTime)
+	}
+}
+
+// updateAlertRules applies a reading to the matching rules in one transaction
+// and returns the rules that fired.
+func updateAlertRules(plantID, logType string, value float64, logTime time.Time) ([]AlertRule, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(
+		`SELECT rule_id, comparison, threshold, duration, hysteresis, state, breach_started_at, last_fired_at, last_cleared_at
+		 FROM alert_rules
+		 WHERE plant_id = ? AND log_type = ? AND enabled = 1 AND (last_reading_at IS NULL OR last_reading_at <= ?)
+		 FOR UPDATE`,
+		plantID, logType, logTime,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("select rules: %w", err)
+	}
+	var rules []AlertRule
+	for rows.Next() {
+		rule := AlertRule{PlantID: plantID, LogType: logType}
+		var breachStr, firedStr, clearedStr sql.NullString
+		if err := rows.Scan(&rule.RuleID, &rule.Comparison, &rule.Threshold, &rule.Duration, &rule.Hysteresis, &rule.State, &breachStr, &firedStr, &clearedStr); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("scan rule: %w", err)
+		}
+		if rule.BreachStarted, err = parseNullDBTime(breachStr); err == nil {
+			if rule.LastFiredAt, err = parseNullDBTime(firedStr); err == nil {
+				rule.LastClearedAt, err = parseNullDBTime(clearedStr)
+			}
+		}
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate rules: %w", err)
+	}
+	if len(rules) == 0 {
+		return nil, nil
+	}
+
+	var fired []AlertRule
+	for i := range rules {
+		rule := &rules[i]
+		transition := evaluateAlertRule(rule, value, logTime)
+		_, err := tx.Exec(
+			`UPDATE alert_rules SET state = ?, breach_started_at = ?, last_fired_at = ?, last_cleared_at = ?, last_reading_at = ?
+			 WHERE rule_id = ?`,
+			rule.State, rule.BreachStarted, rule.LastFiredAt, rule.LastClearedAt, logTime, rule.RuleID,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("update rule %d: %w", rule.RuleID, err)
+		}
+		if transition == alertFired {
+			fired = append(fired, *rule)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("commit: %w", err)
+	}
+	return fired, nil
+}
+
+// notifyAlert tells the owner of a plant that one of its rules fired.
+func notifyAlert(rule AlertRule, value float64) {
+	st, _ := sensorTypes.get(rule.LogType)
+	name := st.DisplayName
+	if name == "" {
+		name = rule.LogType
+	}
+	extra := map[string]interface{}{
+		"LogType":     rule.LogType,
+		"DisplayName": name,
+		"Unit":        st.Unit,
+		"Value":       st.round(value),
+		"Comparison":  rule.Comparison,
+		"Threshold":   rule.Threshold,
+		"Duration":    "",
+	}
+	if d, _ := time.ParseDuration(rule.Duration); d > 0 {
+		extra["Duration"] = d.String()
+	}
+	if _, err := notifyPlantOwner(rule.PlantID, "ALERT", extra); err != nil {
+		log.Printf("alerts: error queueing alert notification: %v", err)
+	}
+}
+
+// validateAlertRule checks a rule submitted by a user.
+func validateAlertRule(rule *AlertRule) error {
+	if _, ok := sensorTypes.get(rule.LogType); !ok {
+		return fmt.Errorf("unknown logType %q", rule.LogType)
+	}
+	if rule.Comparison != alertBelow && rule.Comparison != alertAbove {
+		return fmt.Errorf("comparison must be %q or %q", alertBelow, alertAbove)
+	}
+	if rule.Duration == "" {
+		rule.Duration = "0s"
+	}
+	d, err := time.ParseDuration(rule.Duration)
+	if err != nil || d < 0 || d > maxAlertDuration {
+		return fmt.Errorf("duration must be a duration between 0s and %v", maxAlertDuration)
+	}
+	if rule.Hysteresis < 0 {
+		return fmt.Errorf("hysteresis must not be negative")
+	}
+	return nil
+}
+
+// verifyAlertRuleOwnership checks that the rule exists and belongs to one of
+// userID's plants. If not, it writes an error response and returns false.
+func verifyAlertRuleOwnership(w http.ResponseWriter, userID int, ruleID int64) bool {
+	var plantID string
+	err := db.QueryRow("SELECT plant_id FROM alert_rules WHERE rule_id = ?", ruleID).Scan(&plantID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "alert rule not found", http.StatusNotFound)
+		return false
+	} else if err != nil {
+		log.Printf("Error looking up alert rule: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return false
+	}
+	return verifyPlantOwnership(w, userID, plantID)
+}
+
+// Request body for creating or updating an alert rule
+type alertRuleRequest struct {
+	RuleID     int64   `json:"ruleId"`
+	PlantID    string  `json:"plantId"`
+	LogType    string  `json:"logType"`
+	Comparison string  `json:"comparison"`
+	Threshold  float64 `json:"threshold"`
+	Duration   string  `json:"duration"`
+	Hysteresis float64 `json:"hysteresis"`
+	Enabled    *bool   `json:"enabled"`
+}
+
+func (req alertRuleRequest) rule() AlertRule {
+	return AlertRule{
+		RuleID:     req.RuleID,
+		PlantID:    req.PlantID,
+		LogType:    req.LogType,
+		Comparison: req.Comparison,
+		Threshold:  req.Threshold,
+		Duration:   req.Duration,
+		Hysteresis: req.Hysteresis,
+		Enabled:    req.Enabled == nil || *req.Enabled,
+		State:      alertOK,
+	}
+}
+
+// handleCreateAlertRule lets a user add an alert rule to one of their plants.
+// Expects POST JSON body:
+//
+//	{
+//	    "plantId": "string",
+//	    "logType": "moisture",
+//	    "comparison": "below" | "above",
+//	    "threshold": 20,
+//	    "duration": "30m",    // how long the condition must hold, default "0s"
+//	    "hysteresis": 5,      // how far back past the threshold clears it, default 0
+//	    "enabled": true       // default true
+//	}
+//
+// A rule fires once when its condition has held for the duration, then not
+// again until the reading has recovered past threshold ± hysteresis.
+func handleCreateAlertRule(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, ok := getSessionUserID(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req alertRuleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.PlantID == "" {
+		http.Error(w, "plantId is required", http.StatusBadRequest)
+		return
+	}
+
+	rule := req.rule()
+	if err := validateAlertRule(&rule); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !verifyPlantOwnership(w, userID, req.PlantID) {
+		return
+	}
+
+	rule.CreatedAt = time.Now().UTC().Truncate(time.Second)
+	res, err := db.Exec(
+		`INSERT INTO alert_rules (plant_id, log_type, comparison, threshold, duration, hysteresis, enabled, state, created_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		rule.PlantID, rule.LogType, rule.Comparison, rule.Threshold, rule.Duration, rule.Hysteresis, rule.Enabled, rule.State, rule.CreatedAt,
+	)
+	if err != nil {
+		log.Printf("Error inserting alert rule: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	rule.RuleID, _ = res.LastInsertId()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(rule)
+}
+
+// handleGetAlertRules lists the alert rules of one of the user's plants,
+// including their current state and when each last fired and cleared.
+// Expects GET with query parameter plantId.
+func handleGetAlertRules(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, ok := getSessionUserID(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	plantID := r.URL.Query().Get("plantId")
+	if plantID == "" {
+		http.Error(w, "plantId is required", http.StatusBadRequest)
+		return
+	}
+
+	if !verifyPlantOwnership(w, userID, plantID) {
+		return
+	}
+
+	rows, err := db.Query(
+		`SELECT rule_id, log_type, comparison, threshold, duration, hysteresis, enabled, state,
+		        breach_started_at, last_fired_at, last_cleared_at, created_at
+		 FROM alert_rules WHERE plant_id = ? ORDER BY rule_id`,
+		plantID,
+	)
+	if err != nil {
+		log.Printf("Error querying alert rules: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	rules := make([]AlertRule, 0)
+	for rows.Next() {
+		rule := AlertRule{PlantID: plantID}
+		var createdStr string
+		var breachStr, firedStr, clearedStr sql.NullString
+		if err := rows.Scan(&rule.RuleID, &rule.LogType, &rule.Comparison, &rule.Threshold, &rule.Duration, &rule.Hysteresis,
+			&rule.Enabled, &rule.State, &breachStr, &firedStr, &clearedStr, &createdStr); err != nil {
+			log.Printf("Error scanning alert rule row: %v", err)
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+		if rule.BreachStarted, err = parseNullDBTime(breachStr); err == nil {
+			if rule.LastFiredAt, err = parseNullDBTime(firedStr); err == nil {
+				if rule.LastClearedAt, err = parseNullDBTime(clearedStr); err == nil {
+					rule.CreatedAt, err = parseDBTime(createdStr)
+				}
+			}
+		}
+		if err != nil {
+			log.Printf("Error parsing alert rule times: %v", err)
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+		rules = append(rules, rule)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rules)
+}
+
+// handleUpdateAlertRule replaces the settings of one of the user's alert
+// rules. Expects POST JSON body like handleCreateAlertRule's plus "ruleId";
+// plantId is ignored. The rule's state is reset to ok, so an updated rule
+// starts evaluating from the next reading.
+func handleUpdateAlertRule(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, ok := getSessionUserID(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req alertRuleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	rule := req.rule()
+	if err := validateAlertRule(&rule); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !verifyAlertRuleOwnership(w, userID, req.RuleID) {
+		return
+	}
+
+	_, err := db.Exec(
+		`UPDATE alert_rules SET log_type = ?, comparison = ?, threshold = ?, duration = ?, hysteresis = ?, enabled = ?,
+		        state = ?, breach_started_at = NULL
+		 WHERE rule_id = ?`,
+		rule.LogType, rule.Comparison, rule.Threshold, rule.Duration, rule.Hysteresis, rule.Enabled, rule.State, req.RuleID,
+	)
+	if err != nil {
+		log.Printf("Error updating alert rule: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"status": "updated"})
+}
+
+// Request body for deleting an alert rule
+type deleteAlertRuleRequest struct {
+	RuleID int64 `json:"ruleId"`
+}
+
+// handleDeleteAlertRule deletes one of the user's alert rules.
+// Expects POST JSON body: { "ruleId": <id> }
+func handleDeleteAlertRule(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, ok := getSessionUserID(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req deleteAlertRuleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if !verifyAlertRuleOwnership(w, userID, req.RuleID) {
+		return
+	}
+
+	if _, err := db.Exec("DELETE FROM alert_rules WHERE rule_id = ?", req.RuleID); err != nil {
+		log.Printf("Error deleting alert rule: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"status": "deleted"})
+}
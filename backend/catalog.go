@@ -0,0 +1,202 @@
+// `catalog.go` contains the catalog of commands each type of plant understands
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// Command is a structured command sent to a plant: a name plus typed arguments,
+// e.g. {"name": "water", "args": {"durationMs": 3000}}.
+type Command struct {
+	Name string                 `json:"name"`
+	Args map[string]interface{} `json:"args,omitempty"`
+}
+
+// UnmarshalJSON accepts either a command object or a bare command name such as
+// "WATER", which is what the UI and scripts used to send.
+func (c *Command) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		*c = Command{Name: strings.ToLower(name)}
+		return nil
+	}
+	type plain Command
+	var p plain
+	if err := json.Unmarshal(data, &p); err != nil {
+		return err
+	}
+	*c = Command(p)
+	return nil
+}
+
+// legacyString is how the command is delivered to firmware that only
+// understands a plain string: the upper-cased command name.
+func (c Command) legacyString() string {
+	return strings.ToUpper(c.Name)
+}
+
+// decodeStoredCommand decodes the command column of plant_commands. Rows
+// queued before commands were structured hold a plain string.
+func decodeStoredCommand(s string) Command {
+	var c Command
+	if err := json.Unmarshal([]byte(s), &c); err != nil || c.Name == "" {
+		return Command{Name: strings.ToLower(s)}
+	}
+	return c
+}
+
+// argument types a command can take
+const (
+	argInt    = "int"
+	argNumber = "number"
+	argBool   = "bool"
+	argString = "string"
+)
+
+type commandArgSpec struct {
+	Name     string      `json:"name"`
+	Label    string      `json:"label"`
+	Type     string      `json:"type"`
+	Required bool        `json:"required"`
+	Min      *float64    `json:"min,omitempty"`
+	Max      *float64    `json:"max,omitempty"`
+	Default  interface{} `json:"default,omitempty"`
+}
+
+type commandSpec struct {
+	Name        string           `json:"name"`
+	Label       string           `json:"label"`
+	Description string           `json:"description"`
+	Args        []commandArgSpec `json:"args"`
+}
+
+func floatPtr(f float64) *float64 {
+	return &f
+}
+
+func waterCommand(defaultMs, maxMs float64) commandSpec {
+	return commandSpec{
+		Name:        "water",
+		Label:       "Water Plant",
+		Description: "Run the pump for the given duration.",
+		Args: []commandArgSpec{
+			{Name: "durationMs", Label: "Duration (ms)", Type: argInt, Min: floatPtr(500), Max: floatPtr(maxMs), Default: defaultMs},
+		},
+	}
+}
+
+var readSensorsCommand = commandSpec{
+	Name:        "read_sensors",
+	Label:       "Read Sensors",
+	Description: "Take and log a reading from every sensor right away.",
+	Args:        []commandArgSpec{},
+}
+
+// commandCatalog maps a plant_type to the commands that type of plant accepts.
+// Plant types that aren't listed use the "default" entry.
+var commandCatalog = map[string][]commandSpec{
+	"default":   {waterCommand(3000, 20000), readSensorsCommand},
+	"tomato":    {waterCommand(5000, 30000), readSensorsCommand},
+	"basil":     {waterCommand(3000, 15000), readSensorsCommand},
+	"succulent": {waterCommand(1000, 5000), readSensorsCommand},
+}
+
+// commandsForPlantType returns the catalog entry for a plant type.
+func commandsForPlantType(plantType string) []commandSpec {
+	if specs, ok := commandCatalog[plantType]; ok {
+		return specs
+	}
+	return commandCatalog["default"]
+}
+
+// validateCommand checks a command against the catalog for a plant type and
+// returns a normalized copy with defaults filled in and integer arguments
+// converted to ints.
+func validateCommand(plantType string, cmd Command) (Command, error) {
+	var spec *commandSpec
+	specs := commandsForPlantType(plantType)
+	for i := range specs {
+		if specs[i].Name == cmd.Name {
+			spec = &specs[i]
+			break
+		}
+	}
+	if spec == nil {
+		return Command{}, fmt.Errorf("unknown command %q for plant type %q", cmd.Name, plantType)
+	}
+
+	for name := range cmd.Args {
+		known := false
+		for _, a := range spec.Args {
+			if a.Name == name {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return Command{}, fmt.Errorf("unknown argument %q for command %q", name, cmd.Name)
+		}
+	}
+
+	out := Command{Name: spec.Name, Args: map[string]interface{}{}}
+	for _, a := range spec.Args {
+		v, ok := cmd.Args[a.Name]
+		if !ok || v == nil {
+			if a.Default != nil {
+				v = a.Default
+			} else if a.Required {
+				return Command{}, fmt.Errorf("argument %q is required", a.Name)
+			} else {
+				continue
+			}
+		}
+		nv, err := validateArg(a, v)
+		if err != nil {
+			return Command{}, err
+		}
+		out.Args[a.Name] = nv
+	}
+	if len(out.Args) == 0 {
+		out.Args = nil
+	}
+	return out, nil
+}
+
+func validateArg(a commandArgSpec, v interface{}) (interface{}, error) {
+	switch a.Type {
+	case argInt, argNumber:
+		f, ok := v.(float64)
+		if !ok {
+			return nil, fmt.Errorf("argument %q must be a number", a.Name)
+		}
+		if a.Type == argInt && f != math.Trunc(f) {
+			return nil, fmt.Errorf("argument %q must be an integer", a.Name)
+		}
+		if a.Min != nil && f < *a.Min {
+			return nil, fmt.Errorf("argument %q must be at least %v", a.Name, *a.Min)
+		}
+		if a.Max != nil && f > *a.Max {
+			return nil, fmt.Errorf("argument %q must be at most %v", a.Name, *a.Max)
+		}
+		if a.Type == argInt {
+			return int64(f), nil
+		}
+		return f, nil
+	case argBool:
+		b, ok := v.(bool)
+		if !ok {
+			return nil, fmt.Errorf("argument %q must be a boolean", a.Name)
+		}
+		return b, nil
+	case argString:
+		s, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("argument %q must be a string", a.Name)
+		}
+		return s, nil
+	}
+	return nil, fmt.Errorf("argument %q has unsupported type %q", a.Name, a.Type)
+}
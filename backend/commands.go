@@ -0,0 +1,367 @@
+// `commands.go` contains the database-backed queue of commands issued to plants
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// commandStatus is the lifecycle state of a queued plant command.
+type commandStatus string
+
+const (
+	commandQueued       commandStatus = "queued"
+	commandDelivered    commandStatus = "delivered"
+	commandAcknowledged commandStatus = "acknowledged"
+	commandExpired      commandStatus = "expired"
+)
+
+// Commands that sit in the queue longer than this are marked expired instead
+// of being delivered, so a plant that was offline for a day doesn't get a
+// backlog of stale waterings the moment it reconnects.
+const commandExpiry = 24 * time.Hour
+
+// A command delivered to a plant that can acknowledge it is redelivered if no
+// acknowledgement arrives within commandAckTimeout, up to
+// commandMaxDeliveries times before it is given up on and marked expired.
+const (
+	commandAckTimeout    = 2 * time.Minute
+	commandMaxDeliveries = 5
+)
+
+var errCommandNotFound = errors.New("command not found")
+var errCommandAlreadyAcked = errors.New("command already acknowledged")
+var errCommandExpired = errors.New("command expired")
+var errCommandNotDelivered = errors.New("command not delivered yet")
+
+// commandExpiredCondition matches commands that are due to be marked expired:
+// queued for longer than commandExpiry, or delivered without an
+// acknowledgement in time and either that old or out of deliveries. It is
+// never NULL, so it can be negated. Its parameters come from
+// commandExpiredArgs.
+const commandExpiredCondition = `((status = ? AND created_at < ?) OR
+	 (status = ? AND ack_deadline IS NOT NULL AND ack_deadline < ? AND (created_at < ? OR delivery_count >= ?)))`
+
+// commandExpiredArgs returns the parameters of commandExpiredCondition.
+func commandExpiredArgs(now time.Time) []interface{} {
+	return []interface{}{
+		commandQueued, now.Add(-commandExpiry),
+		commandDelivered, now, now.Add(-commandExpiry), commandMaxDeliveries,
+	}
+}
+
+// PlantCommand is a single row of the plant_commands table.
+type PlantCommand struct {
+	CommandID      int64         `json:"commandId"`
+	PlantID        string        `json:"plantId"`
+	Command        Command       `json:"command"`
+	Status         commandStatus `json:"status"`
+	CreatedAt      time.Time     `json:"createdAt"`
+	DeliveredAt    *time.Time    `json:"deliveredAt,omitempty"`
+	DeliveryCount  int           `json:"deliveryCount"`
+	AcknowledgedAt *time.Time    `json:"acknowledgedAt,omitempty"`
+	Success        *bool         `json:"success,omitempty"`
+	ResultMessage  string        `json:"resultMessage,omitempty"`
+}
+
+// enqueueCommand stores a new command for a plant with status "queued".
+// The command should already have been checked with validateCommand.
+func enqueueCommand(plantID string, command Command) (PlantCommand, error) {
+	now := time.Now().UTC().Truncate(time.Second)
+	encoded, err := json.Marshal(command)
+	if err != nil {
+		return PlantCommand{}, fmt.Errorf("encode command: %w", err)
+	}
+	res, err := db.Exec(
+		"INSERT INTO plant_commands (plant_id, command, status, created_at) VALUES (?, ?, ?, ?)",
+		plantID, string(encoded), commandQueued, now,
+	)
+	if err != nil {
+		return PlantCommand{}, fmt.Errorf("insert command: %w", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return PlantCommand{}, fmt.Errorf("insert command id: %w", err)
+	}
+	return PlantCommand{
+		CommandID: id,
+		PlantID:   plantID,
+		Command:   command,
+		Status:    commandQueued,
+		CreatedAt: now,
+	}, nil
+}
+
+// commandNotifier lets long-polling fetches wait for a command to be queued
+// for their plant. It is safe for concurrent use.
+type commandNotifier struct {
+	mu      sync.Mutex
+	waiters map[string]map[chan struct{}]struct{}
+}
+
+var commandWaiters = &commandNotifier{waiters: make(map[string]map[chan struct{}]struct{})}
+
+// subscribe returns a channel that is closed the next time a command is queued
+// for plantID, and a function to call when the caller stops waiting.
+func (n *commandNotifier) subscribe(plantID string) (<-chan struct{}, func()) {
+	ch := make(chan struct{})
+	n.mu.Lock()
+	if n.waiters[plantID] == nil {
+		n.waiters[plantID] = make(map[chan struct{}]struct{})
+	}
+	n.waiters[plantID][ch] = struct{}{}
+	n.mu.Unlock()
+
+	return ch, func() {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		if _, ok := n.waiters[plantID][ch]; ok {
+			delete(n.waiters[plantID], ch)
+			if len(n.waiters[plantID]) == 0 {
+				delete(n.waiters, plantID)
+			}
+		}
+	}
+}
+
+// notify wakes everything waiting on plantID.
+func (n *commandNotifier) notify(plantID string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for ch := range n.waiters[plantID] {
+		close(ch)
+	}
+	delete(n.waiters, plantID)
+}
+
+// issueCommand queues a validated command for a plant, then pushes it over the
+// plant's WebSocket if it is connected or otherwise wakes any long-polling
+// fetch for it. Everything that sends a command to a plant (user requests and
+// schedules) goes through here.
+func issueCommand(plantID string, command Command) (PlantCommand, error) {
+	cmd, err := enqueueCommand(plantID, command)
+	if err != nil {
+		return cmd, err
+	}
+	events.publish(plantID, eventCommand, commandEvent{CommandID: cmd.CommandID, Status: cmd.Status, Command: &cmd.Command})
+	if devices.online(plantID) {
+		pushQueuedCommands(plantID)
+	} else {
+		commandWaiters.notify(plantID)
+	}
+	return cmd, nil
+}
+
+// takeQueuedCommands returns the commands that should be delivered to a plant,
+// oldest first, and marks them delivered. That is every queued command plus,
+// for ack-capable plants, every delivered command whose ack deadline passed.
+// Commands older than commandExpiry or delivered commandMaxDeliveries times
+// are marked expired instead. The rows are locked for the duration of the
+// transaction so two concurrent fetches can't both deliver a command.
+//
+// When expectAck is false (legacy firmware that never acknowledges) no ack
+// deadline is set, so the commands are never redelivered.
+func takeQueuedCommands(plantID string, expectAck bool) ([]PlantCommand, error) {
+	now := time.Now().UTC().Truncate(time.Second)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	expired, err := selectCommandIDs(tx,
+		"SELECT command_id FROM plant_commands WHERE plant_id = ? AND "+commandExpiredCondition+" FOR UPDATE",
+		append([]interface{}{plantID}, commandExpiredArgs(now)...)...,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("select expired commands: %w", err)
+	}
+	for _, id := range expired {
+		if _, err := tx.Exec(
+			"UPDATE plant_commands SET status = ?, ack_deadline = NULL WHERE command_id = ?",
+			commandExpired, id,
+		); err != nil {
+			return nil, fmt.Errorf("expire command: %w", err)
+		}
+	}
+
+	rows, err := tx.Query(
+		`SELECT command_id, command, created_at, delivery_count FROM plant_commands
+		 WHERE plant_id = ? AND (status = ? OR (status = ? AND ack_deadline < ?))
+		 ORDER BY command_id FOR UPDATE`,
+		plantID, commandQueued, commandDelivered, now,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("select commands: %w", err)
+	}
+	cmds := make([]PlantCommand, 0)
+	for rows.Next() {
+		c := PlantCommand{PlantID: plantID, Status: commandDelivered, DeliveredAt: &now}
+		var commandStr, createdStr string
+		if err := rows.Scan(&c.CommandID, &commandStr, &createdStr, &c.DeliveryCount); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("scan command: %w", err)
+		}
+		c.Command = decodeStoredCommand(commandStr)
+		if c.CreatedAt, err = parseDBTime(createdStr); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		c.DeliveryCount++
+		cmds = append(cmds, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate commands: %w", err)
+	}
+
+	var ackDeadline interface{}
+	if expectAck {
+		ackDeadline = now.Add(commandAckTimeout)
+	}
+	for _, c := range cmds {
+		if _, err := tx.Exec(
+			"UPDATE plant_commands SET status = ?, delivered_at = ?, ack_deadline = ?, delivery_count = ? WHERE command_id = ?",
+			commandDelivered, now, ackDeadline, c.DeliveryCount, c.CommandID,
+		); err != nil {
+			return nil, fmt.Errorf("mark delivered: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("commit: %w", err)
+	}
+
+	for _, id := range expired {
+		events.publish(plantID, eventCommand, commandEvent{CommandID: id, Status: commandExpired})
+	}
+	for _, c := range cmds {
+		events.publish(plantID, eventCommand, commandEvent{CommandID: c.CommandID, Status: commandDelivered})
+	}
+	return cmds, nil
+}
+
+// selectCommandIDs runs a query returning a single column of command IDs.
+func selectCommandIDs(tx *sql.Tx, query string, args ...interface{}) ([]int64, error) {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// acknowledgeCommand records a plant's acknowledgement of one of its commands
+// along with whether it was carried out successfully. It returns
+// errCommandNotFound if the command doesn't exist or belongs to another
+// plant, errCommandNotDelivered if it hasn't been delivered yet,
+// errCommandAlreadyAcked if it was acknowledged before, and errCommandExpired
+// if it was given up on before the acknowledgement came. A command that is
+// due to expire is expired here, whether or not a fetch has swept it yet.
+func acknowledgeCommand(plantID string, commandID int64, success bool, message string) error {
+	now := time.Now().UTC().Truncate(time.Second)
+	args := append([]interface{}{
+		commandAcknowledged, now, success, nullableString(message),
+		commandID, plantID, commandDelivered,
+	}, commandExpiredArgs(now)...)
+	res, err := db.Exec(
+		`UPDATE plant_commands SET status = ?, acknowledged_at = ?, success = ?, result_message = ?, ack_deadline = NULL
+		 WHERE command_id = ? AND plant_id = ? AND status = ? AND NOT `+commandExpiredCondition,
+		args...,
+	)
+	if err != nil {
+		return fmt.Errorf("acknowledge command: %w", err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("acknowledge command: %w", err)
+	} else if n > 0 {
+		events.publish(plantID, eventCommand, commandEvent{CommandID: commandID, Status: commandAcknowledged, Success: &success, Message: message})
+		return nil
+	}
+
+	res, err = db.Exec(
+		"UPDATE plant_commands SET status = ?, ack_deadline = NULL WHERE command_id = ? AND plant_id = ? AND "+commandExpiredCondition,
+		append([]interface{}{commandExpired, commandID, plantID}, commandExpiredArgs(now)...)...,
+	)
+	if err != nil {
+		return fmt.Errorf("expire command: %w", err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("expire command: %w", err)
+	} else if n > 0 {
+		events.publish(plantID, eventCommand, commandEvent{CommandID: commandID, Status: commandExpired})
+		return errCommandExpired
+	}
+
+	var status string
+	err = db.QueryRow("SELECT status FROM plant_commands WHERE command_id = ? AND plant_id = ?", commandID, plantID).Scan(&status)
+	if err == sql.ErrNoRows {
+		return errCommandNotFound
+	} else if err != nil {
+		return fmt.Errorf("check command: %w", err)
+	}
+	switch commandStatus(status) {
+	case commandExpired:
+		return errCommandExpired
+	case commandQueued:
+		return errCommandNotDelivered
+	}
+	return errCommandAlreadyAcked
+}
+
+// listCommands returns the most recent commands issued to a plant, newest first.
+func listCommands(plantID string, limit int) ([]PlantCommand, error) {
+	rows, err := db.Query(
+		`SELECT command_id, command, status, created_at, delivered_at, delivery_count, acknowledged_at, success, result_message
+		 FROM plant_commands WHERE plant_id = ? ORDER BY command_id DESC LIMIT ?`,
+		plantID, limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("select commands: %w", err)
+	}
+	defer rows.Close()
+
+	cmds := make([]PlantCommand, 0)
+	for rows.Next() {
+		c := PlantCommand{PlantID: plantID}
+		var commandStr, createdStr string
+		var deliveredStr, ackedStr, message sql.NullString
+		var success sql.NullBool
+		if err := rows.Scan(&c.CommandID, &commandStr, &c.Status, &createdStr, &deliveredStr,
+			&c.DeliveryCount, &ackedStr, &success, &message); err != nil {
+			return nil, fmt.Errorf("scan command: %w", err)
+		}
+		c.Command = decodeStoredCommand(commandStr)
+		if c.CreatedAt, err = parseDBTime(createdStr); err != nil {
+			return nil, err
+		}
+		if c.DeliveredAt, err = parseNullDBTime(deliveredStr); err != nil {
+			return nil, err
+		}
+		if c.AcknowledgedAt, err = parseNullDBTime(ackedStr); err != nil {
+			return nil, err
+		}
+		if success.Valid {
+			c.Success = &success.Bool
+		}
+		c.ResultMessage = message.String
+		cmds = append(cmds, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate commands: %w", err)
+	}
+	return cmds, nil
+}
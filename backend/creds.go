@@ -7,29 +7,37 @@ import (
 	"fmt"
 	"log"
 	"net/http"
-	"strconv"
+	"strings"
+	"time"
 
+	"github.com/go-sql-driver/mysql"
 	"golang.org/x/crypto/bcrypt"
 )
 
 const cookieName = "potbot_session"
 
-func setSessionCookie(w http.ResponseWriter, userID int) {
-	value := map[string]string{"user_id": strconv.Itoa(userID)}
-	if encoded, err := secCookie.Encode(cookieName, value); err == nil {
-		cookie := &http.Cookie{
-			Name:     cookieName,
-			Value:    encoded,
-			Path:     "/",
-			HttpOnly: true,
-			Secure:   false, // set to true in production with HTTPS
-			SameSite: http.SameSiteLaxMode,
-			MaxAge:   86400,
-		}
-		http.SetCookie(w, cookie)
-	} else {
-		log.Printf("Error encoding cookie: %v", err)
+// setSessionCookie starts a new session for a user and sets its cookie.
+func setSessionCookie(w http.ResponseWriter, r *http.Request, userID int) error {
+	token, err := createSession(r, userID)
+	if err != nil {
+		return err
+	}
+	value := map[string]string{"session": token}
+	encoded, err := secCookie.Encode(cookieName, value)
+	if err != nil {
+		return fmt.Errorf("encode cookie: %w", err)
 	}
+	cookie := &http.Cookie{
+		Name:     cookieName,
+		Value:    encoded,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   false, // set to true in production with HTTPS
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   int(sessionLifetime / time.Second),
+	}
+	http.SetCookie(w, cookie)
+	return nil
 }
 
 func clearSessionCookie(w http.ResponseWriter) {
@@ -43,22 +51,33 @@ func clearSessionCookie(w http.ResponseWriter) {
 	http.SetCookie(w, cookie)
 }
 
+// getSessionUserID returns the user of the session a request is made in.
 func getSessionUserID(r *http.Request) (int, bool) {
-	c, err := r.Cookie(cookieName)
-
-	if err != nil {
+	token, ok := sessionToken(r)
+	if !ok {
 		return 0, false
 	}
-	var value map[string]string
-	if err = secCookie.Decode(cookieName, c.Value, &value); err != nil {
+	id, _, ok := lookupSession(token)
+	return id, ok
+}
+
+// requireAdmin checks that the request comes from a logged in admin. If not,
+// it writes an error response and returns false.
+func requireAdmin(w http.ResponseWriter, r *http.Request) (int, bool) {
+	id, ok := getSessionUserID(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
 		return 0, false
 	}
-	id_str, ok := value["user_id"]
-	if !ok {
+	var isAdmin bool
+	err := db.QueryRow("SELECT is_admin FROM users WHERE user_id = ?", id).Scan(&isAdmin)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Error checking admin status: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
 		return 0, false
 	}
-	id, err := strconv.Atoi(id_str)
-	if err != nil {
+	if !isAdmin {
+		http.Error(w, "admin access required", http.StatusForbidden)
 		return 0, false
 	}
 	return id, true
@@ -90,17 +109,48 @@ func handleRegister(w http.ResponseWriter, r *http.Request) {
 	}
 	// insert
 	res, err := db.Exec("INSERT INTO users (email, password_hash, username) VALUES (?, ?, ?)", req.Email, string(hash), nullableString(req.Username))
-	if err != nil {
-		http.Error(w, fmt.Sprintf("db error: %v", err), http.StatusBadRequest)
+	if mysqlErr, ok := err.(*mysql.MySQLError); ok && mysqlErr.Number == 1062 {
+		http.Error(w, "could not register with that email or username", http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Printf("Error inserting user: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
 		return
 	}
 	id, _ := res.LastInsertId()
-	setSessionCookie(w, int(id))
-	user := User{UserID: int(id), Email: req.Email, Username: req.Username}
+	if err := setSessionCookie(w, r, int(id)); err != nil {
+		log.Printf("Error starting session: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	// The account exists either way; if the email can't be sent the user is
+	// told, and can ask for another link once logged in
+	var resp struct {
+		User
+		VerificationEmailSent bool `json:"verification_email_sent"`
+	}
+	resp.User = User{UserID: int(id), Email: req.Email, Username: req.Username}
+	if err := sendEmailVerification(int(id), req.Email, req.Username, time.Now().UTC()); err != nil {
+		log.Printf("Error sending verification email: %v", err)
+	} else {
+		resp.VerificationEmailSent = true
+	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(user)
+	json.NewEncoder(w).Encode(resp)
 }
 
+// dummyPasswordHash is compared against when a login names no account, so
+// that takes as long as a wrong password and doesn't give away who has one.
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("potbot"), bcrypt.DefaultCost)
+
+// handleLogin logs a user in by email or username. Repeated failures lock
+// the account for the client's IP, and the IP itself, out for a while; see
+// lockout.go.
+// Expects POST JSON body: { "username": "<email or username>", "password": "<password>" }
+// If the user has TOTP enabled, no session is started yet. The response is
+// { "totpRequired": true, "loginToken": "<token>" }, and the login is finished
+// by handleLoginTOTP.
 func handleLogin(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
@@ -108,21 +158,70 @@ func handleLogin(w http.ResponseWriter, r *http.Request) {
 	}
 	var req struct {
 		Username string `json:"username"`
+		Email    string `json:"email"`
 		Password string `json:"password"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "bad request", http.StatusBadRequest)
 		return
 	}
-	if req.Username == "" || req.Password == "" {
-		http.Error(w, "username and password required", http.StatusBadRequest)
+	login := strings.TrimSpace(req.Username)
+	if login == "" {
+		login = strings.TrimSpace(req.Email)
+	}
+	if login == "" || req.Password == "" {
+		http.Error(w, "email or username and password required", http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now().UTC()
+	ip := clientIP(r)
+	if until, ok := loginIPs.reserve(ip, now); !ok {
+		writeLockedOut(w, until, now)
 		return
 	}
-	var id int
+
+	// Registration doesn't restrict usernames, so one may contain an "@".
+	// Anything that looks like an address is tried as one first.
+	column := "username"
+	if strings.Contains(login, "@") {
+		column = "email"
+	}
+	var user User
 	var hash string
-	var email string
-	err := db.QueryRow("SELECT user_id, password_hash, email FROM users WHERE username = ?", req.Username).Scan(&id, &hash, &email)
+	var username sql.NullString
+	err := db.QueryRow(
+		"SELECT user_id, password_hash, email, username, email_verified, totp_enabled FROM users WHERE "+column+" = ?",
+		login,
+	).Scan(&user.UserID, &hash, &user.Email, &username, &user.EmailVerified, &user.TOTPEnabled)
+	if err == sql.ErrNoRows && column == "email" {
+		err = db.QueryRow(
+			"SELECT user_id, password_hash, email, username, email_verified, totp_enabled FROM users WHERE username = ?",
+			login,
+		).Scan(&user.UserID, &hash, &user.Email, &username, &user.EmailVerified, &user.TOTPEnabled)
+	}
+	if err == sql.ErrNoRows {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(req.Password))
+		http.Error(w, "invalid credentials", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		log.Printf("Error looking up user: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	user.Username = username.String
+
+	// A locked account looks the same as a wrong password, so lockouts
+	// don't tell anyone which accounts exist
+	ok, err := reserveAccountAttempt(user.UserID, ip, now)
 	if err != nil {
+		log.Printf("Error counting login attempt: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(req.Password))
 		http.Error(w, "invalid credentials", http.StatusUnauthorized)
 		return
 	}
@@ -130,8 +229,30 @@ func handleLogin(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "invalid credentials", http.StatusUnauthorized)
 		return
 	}
-	setSessionCookie(w, id)
-	user := User{UserID: id, Email: email, Username: req.Username}
+
+	// Failures are only forgiven once the second step has been passed too
+	if user.TOTPEnabled {
+		token, err := newLoginToken(user.UserID, now)
+		if err != nil {
+			log.Printf("Error encoding login token: %v", err)
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"totpRequired": true, "loginToken": token})
+		return
+	}
+
+	loginIPs.succeed(ip)
+	if err := resetAccountFailures(user.UserID, ip); err != nil {
+		log.Printf("Error resetting failed logins: %v", err)
+	}
+
+	if err := setSessionCookie(w, r, user.UserID); err != nil {
+		log.Printf("Error starting session: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(user)
 }
@@ -141,6 +262,13 @@ func handleLogout(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
+	if token, ok := sessionToken(r); ok {
+		if _, err := db.Exec("DELETE FROM sessions WHERE token_hash = ?", hashToken(token)); err != nil {
+			log.Printf("Error deleting session: %v", err)
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+	}
 	clearSessionCookie(w)
 	w.WriteHeader(http.StatusNoContent)
 }
@@ -157,7 +285,7 @@ func handleMe(w http.ResponseWriter, r *http.Request) {
 	}
 	var u User
 	var username sql.NullString
-	err := db.QueryRow("SELECT user_id, email, username FROM users WHERE user_id = ?", id).Scan(&u.UserID, &u.Email, &username)
+	err := db.QueryRow("SELECT user_id, email, username, email_verified, totp_enabled FROM users WHERE user_id = ?", id).Scan(&u.UserID, &u.Email, &username, &u.EmailVerified, &u.TOTPEnabled)
 	if err != nil {
 		http.Error(w, "user not found", http.StatusUnauthorized)
 		return
@@ -0,0 +1,144 @@
+// `cron.go` contains a small parser for standard 5-field cron expressions
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule is a parsed "minute hour day-of-month month day-of-week"
+// expression. Each field is a bitset of the values it matches.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// domStar/dowStar record whether the day fields were "*". As in classic
+	// cron, when both are restricted a day matches if either one matches.
+	domStar, dowStar bool
+}
+
+type cronField struct {
+	min, max int
+}
+
+var cronFields = []cronField{
+	{0, 59}, // minute
+	{0, 23}, // hour
+	{1, 31}, // day of month
+	{1, 12}, // month
+	{0, 7},  // day of week, 0 and 7 are both Sunday
+}
+
+// parseCron parses a 5-field cron expression such as "0 7 * * *" (every day at
+// 07:00). Fields support "*", single values, ranges "a-b", lists "a,b" and
+// steps "*/n" or "a-b/n".
+func parseCron(expr string) (*cronSchedule, error) {
+	parts := strings.Fields(expr)
+	if len(parts) != 5 {
+		return nil, fmt.Errorf("cron expression must have 5 fields, got %d", len(parts))
+	}
+	var bits [5]uint64
+	for i, p := range parts {
+		b, err := parseCronField(p, cronFields[i])
+		if err != nil {
+			return nil, fmt.Errorf("cron field %q: %w", p, err)
+		}
+		bits[i] = b
+	}
+	// fold Sunday=7 into Sunday=0
+	if bits[4]&(1<<7) != 0 {
+		bits[4] |= 1
+	}
+	return &cronSchedule{
+		minute:  bits[0],
+		hour:    bits[1],
+		dom:     bits[2],
+		month:   bits[3],
+		dow:     bits[4],
+		domStar: parts[2] == "*",
+		dowStar: parts[4] == "*",
+	}, nil
+}
+
+func parseCronField(s string, f cronField) (uint64, error) {
+	var bits uint64
+	for _, item := range strings.Split(s, ",") {
+		rangePart, step := item, 1
+		if i := strings.Index(item, "/"); i >= 0 {
+			n, err := strconv.Atoi(item[i+1:])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step %q", item[i+1:])
+			}
+			rangePart, step = item[:i], n
+		}
+
+		lo, hi := f.min, f.max
+		if rangePart != "*" {
+			if i := strings.Index(rangePart, "-"); i >= 0 {
+				var err error
+				if lo, err = strconv.Atoi(rangePart[:i]); err != nil {
+					return 0, fmt.Errorf("invalid value %q", rangePart[:i])
+				}
+				if hi, err = strconv.Atoi(rangePart[i+1:]); err != nil {
+					return 0, fmt.Errorf("invalid value %q", rangePart[i+1:])
+				}
+			} else {
+				n, err := strconv.Atoi(rangePart)
+				if err != nil {
+					return 0, fmt.Errorf("invalid value %q", rangePart)
+				}
+				lo, hi = n, n
+				if step > 1 {
+					hi = f.max
+				}
+			}
+		}
+		if lo < f.min || hi > f.max || lo > hi {
+			return 0, fmt.Errorf("value out of range %d-%d", f.min, f.max)
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func (c *cronSchedule) dayMatches(t time.Time) bool {
+	domMatch := c.dom&(1<<uint(t.Day())) != 0
+	dowMatch := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domStar || c.dowStar {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
+
+// next returns the first time strictly after `after` that matches the
+// schedule, evaluated in loc. It returns the zero time if nothing matches in
+// the next five years (e.g. "0 0 30 2 *").
+func (c *cronSchedule) next(after time.Time, loc *time.Location) time.Time {
+	t := after.In(loc).Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		var nt time.Time
+		switch {
+		case c.month&(1<<uint(t.Month())) == 0:
+			nt = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+		case !c.dayMatches(t):
+			nt = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			nt = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+		case c.minute&(1<<uint(t.Minute())) == 0:
+			nt = t.Add(time.Minute)
+		default:
+			return t
+		}
+		if !nt.After(t) {
+			// The wall clock time we wanted to skip to doesn't exist (DST
+			// gap) and time.Date normalized it backwards.
+			nt = t.Add(time.Hour - time.Duration(t.Minute())*time.Minute)
+		}
+		t = nt
+	}
+	return time.Time{}
+}
@@ -0,0 +1,196 @@
+// `emailverify.go` contains the verification of users' email addresses. A
+// link is emailed at registration, and notifications are only emailed to
+// addresses that have been verified through one.
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// emailVerificationLifetime is how long an emailed verification link works.
+// It is set from the environment in main.
+var emailVerificationLifetime = 48 * time.Hour
+
+// emailVerificationResendInterval is how often a verification email can be
+// resent to the same account.
+const emailVerificationResendInterval = time.Minute
+
+// errVerificationTooSoon is returned by sendEmailVerification when the last
+// verification email was sent less than emailVerificationResendInterval ago.
+var errVerificationTooSoon = fmt.Errorf("a verification email was sent less than %v ago", emailVerificationResendInterval)
+
+// sendEmailVerification emails a verification link for a user's address.
+// Earlier links stop working.
+func sendEmailVerification(userID int, email, username string, now time.Time) error {
+	var recent int
+	err := db.QueryRow(
+		"SELECT COUNT(*) FROM email_verification_tokens WHERE user_id = ? AND created_at > ?",
+		userID, now.Add(-emailVerificationResendInterval),
+	).Scan(&recent)
+	if err != nil {
+		return fmt.Errorf("count recent verification tokens: %w", err)
+	}
+	if recent > 0 {
+		return errVerificationTooSoon
+	}
+
+	token, err := newToken()
+	if err != nil {
+		return err
+	}
+	if _, err := db.Exec("DELETE FROM email_verification_tokens WHERE user_id = ?", userID); err != nil {
+		return fmt.Errorf("delete old verification tokens: %w", err)
+	}
+	now = now.Truncate(time.Second)
+	_, err = db.Exec(
+		"INSERT INTO email_verification_tokens (token_hash, user_id, email, created_at, expires_at) VALUES (?, ?, ?, ?, ?)",
+		hashToken(token), userID, email, now, now.Add(emailVerificationLifetime),
+	)
+	if err != nil {
+		return fmt.Errorf("insert verification token: %w", err)
+	}
+
+	link := strings.TrimRight(publicURL, "/") + "/?verify_token=" + url.QueryEscape(token)
+	body := fmt.Sprintf(
+		"Hi %s,\n\nPlease confirm that this is your email address by opening this link within %s:\n\n%s\n\nPotbot only emails you about your plants once your address is confirmed. If you didn't create a Potbot account, you can ignore this email.\n",
+		displayName(username), emailVerificationLifetime, link,
+	)
+	if err := sendEmail(email, "Confirm your Potbot email address", body); err != nil {
+		// A link that never arrived shouldn't hold up asking for another
+		if _, delErr := db.Exec("DELETE FROM email_verification_tokens WHERE token_hash = ?", hashToken(token)); delErr != nil {
+			log.Printf("Error deleting unsent verification token: %v", delErr)
+		}
+		return fmt.Errorf("send verification email: %w", err)
+	}
+	return nil
+}
+
+// handleConfirmEmail marks a user's email address as verified using an
+// emailed token. It doesn't need a session, since the link may be opened in
+// another browser.
+// Expects POST JSON body: { "token": "<token>" }
+func handleConfirmEmail(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Token == "" {
+		http.Error(w, "token required", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC().Truncate(time.Second)
+	var userID int
+	var email string
+	err = tx.QueryRow(
+		"SELECT user_id, email FROM email_verification_tokens WHERE token_hash = ? AND used_at IS NULL AND expires_at > ? FOR UPDATE",
+		hashToken(req.Token), now,
+	).Scan(&userID, &email)
+	if err == sql.ErrNoRows {
+		http.Error(w, "invalid or expired token", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("Error looking up verification token: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := tx.Exec("UPDATE email_verification_tokens SET used_at = ? WHERE token_hash = ?", now, hashToken(req.Token)); err != nil {
+		log.Printf("Error using verification token: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	// The token is for the address it was sent to
+	res, err := tx.Exec("UPDATE users SET email_verified = 1 WHERE user_id = ? AND email = ?", userID, email)
+	if err != nil {
+		log.Printf("Error verifying email: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		var verified bool
+		err := tx.QueryRow("SELECT email_verified FROM users WHERE user_id = ? AND email = ?", userID, email).Scan(&verified)
+		if err == sql.ErrNoRows {
+			http.Error(w, "invalid or expired token", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			log.Printf("Error verifying email: %v", err)
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing email verification: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleResendVerificationEmail sends the logged in user a new verification
+// link, unless their address is already verified.
+func handleResendVerificationEmail(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, ok := getSessionUserID(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var email string
+	var username sql.NullString
+	var verified bool
+	err := db.QueryRow("SELECT email, username, email_verified FROM users WHERE user_id = ?", userID).Scan(&email, &username, &verified)
+	if err != nil {
+		log.Printf("Error looking up user email: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if verified {
+		http.Error(w, "email already verified", http.StatusConflict)
+		return
+	}
+
+	err = sendEmailVerification(userID, email, username.String, time.Now().UTC())
+	if err == errVerificationTooSoon {
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+	if err != nil {
+		log.Printf("Error sending verification email: %v", err)
+		http.Error(w, "could not send verification email", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
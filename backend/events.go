@@ -0,0 +1,161 @@
+// `events.go` contains the in-process event bus that live dashboards subscribe
+// to, and the Server-Sent Events endpoint that streams it to the browser
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// event types published on the bus
+const (
+	eventLog          = "log"
+	eventCommand      = "command"
+	eventNotification = "notification"
+)
+
+// plantEvent is something that happened to a plant that a dashboard may want
+// to show right away.
+type plantEvent struct {
+	Type    string      `json:"type"`
+	PlantID string      `json:"plantId"`
+	Time    time.Time   `json:"time"`
+	Data    interface{} `json:"data"`
+}
+
+// logEvent is the Data of an eventLog event.
+type logEvent struct {
+	LogType string        `json:"logType"`
+	Entry   PlantLogEntry `json:"entry"`
+}
+
+// commandEvent is the Data of an eventCommand event, sent whenever a command
+// is issued or changes status.
+type commandEvent struct {
+	CommandID int64         `json:"commandId"`
+	Status    commandStatus `json:"status"`
+	Command   *Command      `json:"command,omitempty"`
+	Success   *bool         `json:"success,omitempty"`
+	Message   string        `json:"message,omitempty"`
+}
+
+// notificationEvent is the Data of an eventNotification event.
+type notificationEvent struct {
+	NotificationType string `json:"notificationType"`
+}
+
+// eventBus fans events out to subscribers of a plant. It is safe for
+// concurrent use. Publishing never blocks: a subscriber that falls behind
+// misses events rather than holding up the request that published them.
+type eventBus struct {
+	mu   sync.Mutex
+	subs map[string]map[chan plantEvent]struct{}
+}
+
+var events = &eventBus{subs: make(map[string]map[chan plantEvent]struct{})}
+
+// subscribe returns a channel of events for plantID and a function to call
+// when the subscriber goes away.
+func (b *eventBus) subscribe(plantID string) (<-chan plantEvent, func()) {
+	ch := make(chan plantEvent, 32)
+	b.mu.Lock()
+	if b.subs[plantID] == nil {
+		b.subs[plantID] = make(map[chan plantEvent]struct{})
+	}
+	b.subs[plantID][ch] = struct{}{}
+	b.mu.Unlock()
+
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.subs[plantID], ch)
+		if len(b.subs[plantID]) == 0 {
+			delete(b.subs, plantID)
+		}
+	}
+}
+
+// publish sends an event to everyone subscribed to plantID.
+func (b *eventBus) publish(plantID, eventType string, data interface{}) {
+	ev := plantEvent{Type: eventType, PlantID: plantID, Time: time.Now().UTC(), Data: data}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs[plantID] {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// How often a comment line is sent on an idle stream so proxies don't close it.
+const sseHeartbeat = 25 * time.Second
+
+// handlePlantEvents streams live events for one of the user's plants as
+// Server-Sent Events: new readings, command status changes and notifications.
+// Expects GET with query parameter plantId. Each event is sent as
+//
+//	event: <log|command|notification>
+//	data: <plantEvent JSON>
+func handlePlantEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, ok := getSessionUserID(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	plantID := r.URL.Query().Get("plantId")
+	if plantID == "" {
+		http.Error(w, "plantId is required", http.StatusBadRequest)
+		return
+	}
+
+	if !verifyPlantOwnership(w, userID, plantID) {
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	evs, unsubscribe := events.subscribe(plantID)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(sseHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+			flusher.Flush()
+		case ev := <-evs:
+			data, err := json.Marshal(ev)
+			if err != nil {
+				log.Printf("Error encoding event: %v", err)
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data)
+			flusher.Flush()
+		}
+	}
+}
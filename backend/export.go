@@ -0,0 +1,281 @@
+// `export.go` contains the download of a plant's sensor history as CSV or
+// newline-delimited JSON
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// exportFlushEvery is how many rows are written between flushes to the client.
+const exportFlushEvery = 500
+
+// exportWriter writes export rows in one of the supported formats.
+type exportWriter interface {
+	// header is called once with the column names before any rows.
+	header(columns []string) error
+	// row writes one row; nil values are empty cells.
+	row(values []interface{}) error
+	flush() error
+}
+
+type csvExportWriter struct {
+	w *csv.Writer
+}
+
+func (c *csvExportWriter) header(columns []string) error {
+	return c.w.Write(columns)
+}
+
+func (c *csvExportWriter) row(values []interface{}) error {
+	record := make([]string, len(values))
+	for i, v := range values {
+		switch v := v.(type) {
+		case nil:
+		case string:
+			record[i] = v
+		case float64:
+			record[i] = strconv.FormatFloat(v, 'f', -1, 64)
+		default:
+			record[i] = fmt.Sprint(v)
+		}
+	}
+	return c.w.Write(record)
+}
+
+func (c *csvExportWriter) flush() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// ndjsonExportWriter writes each row as a JSON object keyed by column name.
+type ndjsonExportWriter struct {
+	enc     *json.Encoder
+	columns []string
+}
+
+func (n *ndjsonExportWriter) header(columns []string) error {
+	n.columns = columns
+	return nil
+}
+
+func (n *ndjsonExportWriter) row(values []interface{}) error {
+	obj := make(map[string]interface{}, len(values))
+	for i, v := range values {
+		if v != nil {
+			obj[n.columns[i]] = v
+		}
+	}
+	return n.enc.Encode(obj)
+}
+
+func (n *ndjsonExportWriter) flush() error {
+	return nil
+}
+
+// handleExportPlantLogs streams a plant's readings between two times as a
+// download. Expects GET with query parameters:
+//
+//	plantId  the plant to export
+//	start    RFC 3339 start of the range
+//	end      RFC 3339 end of the range, defaults to now
+//	format   "csv" (default) or "ndjson"
+//	layout   "long" (default): one row per reading with columns
+//	           time, logType, value, min, max, count
+//	         "wide": one row per timestamp with a column per sensor type
+//
+// Readings old enough to have been rolled up are exported as their hourly or
+// daily summaries; value is then the average and count the number of readings
+// it covers. Rows are written as they are read from the database, oldest
+// first.
+func handleExportPlantLogs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, ok := getSessionUserID(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	q := r.URL.Query()
+	plantID := q.Get("plantId")
+	if plantID == "" {
+		http.Error(w, "plantId is required", http.StatusBadRequest)
+		return
+	}
+	start, err := time.Parse(time.RFC3339, q.Get("start"))
+	if err != nil {
+		http.Error(w, "start must be an RFC 3339 time", http.StatusBadRequest)
+		return
+	}
+	end := time.Now().UTC()
+	if v := q.Get("end"); v != "" {
+		if end, err = time.Parse(time.RFC3339, v); err != nil {
+			http.Error(w, "end must be an RFC 3339 time", http.StatusBadRequest)
+			return
+		}
+	}
+	if end.Before(start) {
+		http.Error(w, "end must not be before start", http.StatusBadRequest)
+		return
+	}
+
+	format := q.Get("format")
+	if format == "" {
+		format = "csv"
+	}
+	if format != "csv" && format != "ndjson" {
+		http.Error(w, "format must be csv or ndjson", http.StatusBadRequest)
+		return
+	}
+	layout := q.Get("layout")
+	if layout == "" {
+		layout = "long"
+	}
+	if layout != "long" && layout != "wide" {
+		http.Error(w, "layout must be long or wide", http.StatusBadRequest)
+		return
+	}
+
+	if !verifyPlantOwnership(w, userID, plantID) {
+		return
+	}
+
+	filename := fmt.Sprintf("%s_%s_%s", plantID, start.UTC().Format("20060102"), end.UTC().Format("20060102"))
+	var ew exportWriter
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		filename += ".csv"
+		ew = &csvExportWriter{w: csv.NewWriter(w)}
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		filename += ".ndjson"
+		ew = &ndjsonExportWriter{enc: json.NewEncoder(w)}
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+
+	flusher, _ := w.(http.Flusher)
+	written := 0
+	emit := func(values []interface{}) error {
+		if err := ew.row(values); err != nil {
+			return err
+		}
+		written++
+		if written%exportFlushEvery == 0 {
+			if err := ew.flush(); err != nil {
+				return err
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		return nil
+	}
+
+	if layout == "long" {
+		err = exportLongLayout(plantID, start, end, ew, emit)
+	} else {
+		err = exportWideLayout(plantID, start, end, ew, emit)
+	}
+	if err == nil {
+		err = ew.flush()
+	}
+	if err != nil {
+		// The status has already been sent, so all we can do is stop.
+		log.Printf("Error exporting plant logs for %s: %v", plantID, err)
+	}
+}
+
+// exportLongLayout writes one row per reading or summary.
+func exportLongLayout(plantID string, start, end time.Time, ew exportWriter, emit func([]interface{}) error) error {
+	if err := ew.header([]string{"time", "logType", "value", "min", "max", "count"}); err != nil {
+		return err
+	}
+	queries, err := logTierQueries(plantID, start)
+	if err != nil {
+		return err
+	}
+	for _, query := range queries {
+		err := streamLogTier(plantID, start, end, query, func(s logSample) error {
+			st, _ := sensorTypes.get(s.LogType)
+			return emit([]interface{}{
+				s.Time.UTC().Format(time.RFC3339),
+				s.LogType,
+				st.round(s.Sum / float64(s.Count)),
+				st.round(s.Min),
+				st.round(s.Max),
+				s.Count,
+			})
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exportWideLayout writes one row per timestamp with a column per sensor type.
+// Rows come out of the database ordered by time, so only the readings of the
+// current timestamp are held at once.
+func exportWideLayout(plantID string, start, end time.Time, ew exportWriter, emit func([]interface{}) error) error {
+	types := sensorTypes.all()
+	columns := []string{"time"}
+	for _, t := range types {
+		columns = append(columns, t.Name)
+	}
+	if err := ew.header(columns); err != nil {
+		return err
+	}
+
+	var cur time.Time
+	pending := map[string]logSample{}
+	writePending := func() error {
+		if len(pending) == 0 {
+			return nil
+		}
+		values := []interface{}{cur.UTC().Format(time.RFC3339)}
+		for _, t := range types {
+			if s, ok := pending[t.Name]; ok {
+				values = append(values, t.round(s.Sum/float64(s.Count)))
+			} else {
+				values = append(values, nil)
+			}
+		}
+		pending = map[string]logSample{}
+		return emit(values)
+	}
+
+	queries, err := logTierQueries(plantID, start)
+	if err != nil {
+		return err
+	}
+	for _, query := range queries {
+		err := streamLogTier(plantID, start, end, query, func(s logSample) error {
+			if !s.Time.Equal(cur) {
+				if err := writePending(); err != nil {
+					return err
+				}
+				cur = s.Time
+			}
+			// Two readings of a type at the same second are averaged.
+			if prev, ok := pending[s.LogType]; ok {
+				s.Sum += prev.Sum
+				s.Count += prev.Count
+			}
+			pending[s.LogType] = s
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return writePending()
+}
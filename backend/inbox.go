@@ -0,0 +1,253 @@
+// `inbox.go` contains the endpoints a user reads their notification history
+// through. Every notification is kept in the outbox table (see outbox.go), so
+// this is a view of that table.
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Page sizes of handleGetNotifications.
+const (
+	defaultInboxPage = 20
+	maxInboxPage     = 100
+)
+
+// inboxNotification is a notification as shown to its user.
+type inboxNotification struct {
+	NotificationID int64      `json:"notificationId"`
+	PlantID        string     `json:"plantId,omitempty"`
+	PlantName      string     `json:"plantName,omitempty"`
+	Type           string     `json:"type"`
+	Severity       string     `json:"severity"`
+	Subject        string     `json:"subject"`
+	Body           string     `json:"body"`
+	Status         string     `json:"status"`
+	Suppressed     string     `json:"suppressedReason,omitempty"`
+	CreatedAt      time.Time  `json:"createdAt"`
+	SentAt         *time.Time `json:"sentAt,omitempty"`
+	ReadAt         *time.Time `json:"readAt,omitempty"`
+}
+
+// handleGetNotifications lists the logged in user's notifications, newest
+// first. Expects GET with optional query parameters:
+//
+//	limit   page size, default 20, at most 100
+//	before  a notificationId; only older notifications are returned
+//	unread  "true" for unread notifications only
+//	status  pending, sent, failed or suppressed
+//	plantId only notifications about this plant
+//
+// Responds { "notifications": [...], "nextBefore": <id> }, where nextBefore
+// is passed as before to get the next page, and is omitted on the last page.
+func handleGetNotifications(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, ok := getSessionUserID(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	q := r.URL.Query()
+	limit := defaultInboxPage
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+		if limit > maxInboxPage {
+			limit = maxInboxPage
+		}
+	}
+
+	where := []string{"o.user_id = ?"}
+	args := []interface{}{userID}
+	if v := q.Get("before"); v != "" {
+		before, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid before", http.StatusBadRequest)
+			return
+		}
+		where = append(where, "o.notification_id < ?")
+		args = append(args, before)
+	}
+	if q.Get("unread") == "true" {
+		where = append(where, "o.read_at IS NULL")
+	}
+	if v := q.Get("status"); v != "" {
+		switch v {
+		case outboxPending, outboxSent, outboxFailed, outboxSuppressed:
+		default:
+			http.Error(w, "invalid status", http.StatusBadRequest)
+			return
+		}
+		where = append(where, "o.status = ?")
+		args = append(args, v)
+	}
+	if v := q.Get("plantId"); v != "" {
+		where = append(where, "o.plant_id = ?")
+		args = append(args, v)
+	}
+	// Fetch one extra row to tell whether there is another page
+	args = append(args, limit+1)
+
+	rows, err := db.Query(
+		`SELECT o.notification_id, o.plant_id, p.plant_name, o.notification_type, o.severity, o.subject, o.body,
+		        o.status, o.suppressed_reason, o.created_at, o.sent_at, o.read_at
+		 FROM notification_outbox o LEFT JOIN plants p ON p.plant_id = o.plant_id
+		 WHERE `+strings.Join(where, " AND ")+`
+		 ORDER BY o.notification_id DESC LIMIT ?`,
+		args...,
+	)
+	if err != nil {
+		log.Printf("Error querying notifications: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	notifications := make([]inboxNotification, 0, limit)
+	for rows.Next() {
+		var n inboxNotification
+		var plantID, plantName, suppressed, sentStr, readStr sql.NullString
+		var createdStr string
+		if err := rows.Scan(&n.NotificationID, &plantID, &plantName, &n.Type, &n.Severity, &n.Subject, &n.Body,
+			&n.Status, &suppressed, &createdStr, &sentStr, &readStr); err != nil {
+			log.Printf("Error scanning notification row: %v", err)
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+		n.PlantID, n.PlantName, n.Suppressed = plantID.String, plantName.String, suppressed.String
+		if n.CreatedAt, err = parseDBTime(createdStr); err == nil {
+			if n.SentAt, err = parseNullDBTime(sentStr); err == nil {
+				n.ReadAt, err = parseNullDBTime(readStr)
+			}
+		}
+		if err != nil {
+			log.Printf("Error parsing notification times: %v", err)
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+		notifications = append(notifications, n)
+	}
+
+	resp := map[string]interface{}{}
+	if len(notifications) > limit {
+		notifications = notifications[:limit]
+		resp["nextBefore"] = notifications[limit-1].NotificationID
+	}
+	resp["notifications"] = notifications
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// Request body for marking notifications read
+type markNotificationsReadRequest struct {
+	NotificationIDs []int64 `json:"notificationIds"`
+	All             bool    `json:"all"`
+}
+
+// handleMarkNotificationsRead marks some or all of the logged in user's
+// notifications as read.
+// Expects POST JSON body: { "notificationIds": [<id>, ...] } or { "all": true }
+// Responds with the new unread count: { "unread": <n> }
+func handleMarkNotificationsRead(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, ok := getSessionUserID(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req markNotificationsReadRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	if !req.All && len(req.NotificationIDs) == 0 {
+		http.Error(w, "notificationIds or all is required", http.StatusBadRequest)
+		return
+	}
+	if len(req.NotificationIDs) > maxInboxPage {
+		http.Error(w, "too many notificationIds", http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	query := "UPDATE notification_outbox SET read_at = ? WHERE user_id = ? AND read_at IS NULL"
+	args := []interface{}{now, userID}
+	if !req.All {
+		query += " AND notification_id IN (?" + strings.Repeat(", ?", len(req.NotificationIDs)-1) + ")"
+		for _, id := range req.NotificationIDs {
+			args = append(args, id)
+		}
+	}
+	if _, err := db.Exec(query, args...); err != nil {
+		log.Printf("Error marking notifications read: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	unread, err := countUnreadNotifications(userID)
+	if err != nil {
+		log.Printf("Error counting unread notifications: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"unread": unread})
+}
+
+// countUnreadNotifications counts a user's unread notifications. Suppressed
+// ones are left out, since the user chose not to be bothered by them.
+func countUnreadNotifications(userID int) (int, error) {
+	var unread int
+	err := db.QueryRow(
+		"SELECT COUNT(*) FROM notification_outbox WHERE user_id = ? AND read_at IS NULL AND status <> ?",
+		userID, outboxSuppressed,
+	).Scan(&unread)
+	return unread, err
+}
+
+// handleGetUnreadNotificationCount returns the number of the logged in user's
+// unread notifications, for the badge in the navbar: { "unread": <n> }
+func handleGetUnreadNotificationCount(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, ok := getSessionUserID(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	unread, err := countUnreadNotifications(userID)
+	if err != nil {
+		log.Printf("Error counting unread notifications: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"unread": unread})
+}
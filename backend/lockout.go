@@ -0,0 +1,283 @@
+// `lockout.go` contains the protection of logins against password guessing.
+// Failed attempts are counted per account and client IP, in the
+// login_failures table, per client IP alone, in memory, and per account
+// across all IPs, in the users table. Past a number of free attempts, each
+// further failure locks the account (for that IP) or the IP out for twice as
+// long as the last.
+//
+// Failures across all IPs don't lock the account, since then anyone could
+// keep its owner out just by failing to log in to it. Instead, past a number
+// of free attempts, attempts on the account are spaced out: each waits for
+// the account's next free slot, and one that would wait too long is refused
+// like a wrong password. That caps how fast an account can be guessed at
+// from any number of IPs, while its owner still gets in, if a little slowly.
+//
+// An attempt is counted before the password is checked, and only forgiven
+// once the login succeeds, so concurrent guesses can't all slip past the
+// check before the first of them is recorded.
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The first accountFreeAttempts failed logins in a row to an account from an
+// IP, and the first ipFreeAttempts from an IP, are free. The next failure
+// locks the account for that IP, or the IP, out for loginLockoutBase, and
+// each failure after it doubles that, up to loginLockoutMax.
+const (
+	accountFreeAttempts = 5
+	ipFreeAttempts      = 20
+	loginLockoutBase    = time.Minute
+	loginLockoutMax     = time.Hour
+)
+
+// Once an account has had accountWideFreeAttempts failed logins in a row from
+// any IPs, attempts on it are spaced accountThrottleBase apart, doubling with
+// each further failure up to accountThrottleMax. An attempt that would have
+// to wait longer than accountThrottleMaxWait for its turn is refused.
+const (
+	accountWideFreeAttempts = 20
+	accountThrottleBase     = time.Second
+	accountThrottleMax      = 5 * time.Second
+	accountThrottleMaxWait  = 15 * time.Second
+)
+
+// loginFailureMemory is how long failed logins are remembered after the last
+// one.
+const loginFailureMemory = 24 * time.Hour
+
+// lockoutDuration returns how long to lock out after the given number of
+// consecutive failures, or 0 if there are still free attempts left.
+func lockoutDuration(failures, freeAttempts int) time.Duration {
+	if failures <= freeAttempts {
+		return 0
+	}
+	d := loginLockoutBase
+	for i := freeAttempts + 1; i < failures && d < loginLockoutMax; i++ {
+		d *= 2
+	}
+	if d > loginLockoutMax {
+		d = loginLockoutMax
+	}
+	return d
+}
+
+// ipFailures is the failed login count of one IP.
+type ipFailures struct {
+	count       int
+	last        time.Time
+	lockedUntil time.Time
+}
+
+// ipLockout tracks failed logins per IP. It is safe for concurrent use.
+type ipLockout struct {
+	mu       sync.Mutex
+	failures map[string]*ipFailures
+}
+
+var loginIPs = &ipLockout{failures: make(map[string]*ipFailures)}
+
+// reserve counts a login attempt from an IP as failed until succeed is
+// called. If the IP is locked out it counts nothing and returns when it may
+// try again.
+func (l *ipLockout) reserve(ip string, now time.Time) (time.Time, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f, ok := l.failures[ip]
+	if ok && now.Before(f.lockedUntil) {
+		return f.lockedUntil, false
+	}
+	if !ok || now.Sub(f.last) > loginFailureMemory {
+		f = &ipFailures{}
+		l.failures[ip] = f
+		l.prune(now)
+	}
+	f.count++
+	f.last = now
+	if d := lockoutDuration(f.count, ipFreeAttempts); d > 0 {
+		f.lockedUntil = now.Add(d)
+	}
+	return time.Time{}, true
+}
+
+// succeed forgets an IP's failed logins.
+func (l *ipLockout) succeed(ip string) {
+	l.mu.Lock()
+	delete(l.failures, ip)
+	l.mu.Unlock()
+}
+
+// prune forgets IPs that haven't failed a login for loginFailureMemory. The
+// caller holds l.mu.
+func (l *ipLockout) prune(now time.Time) {
+	for ip, f := range l.failures {
+		if now.Sub(f.last) > loginFailureMemory {
+			delete(l.failures, ip)
+		}
+	}
+}
+
+// reserveAccountAttempt counts a login attempt on an account from an IP as
+// failed until resetAccountFailures is called. It returns false, counting
+// nothing, if the account is locked for that IP, or if it is being throttled
+// and the attempt's turn is too far off. Otherwise, if it is being throttled,
+// it waits for the attempt's turn before returning.
+func reserveAccountAttempt(userID int, ip string, now time.Time) (bool, error) {
+	ip, now = truncate(ip, 45), now.Truncate(time.Second)
+	tx, err := db.Begin()
+	if err != nil {
+		return false, fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Unlike INSERT IGNORE, this locks an existing row exclusively, so
+	// concurrent attempts queue here rather than deadlock below
+	_, err = tx.Exec(
+		`INSERT INTO login_failures (user_id, ip, failures, last_failure_at) VALUES (?, ?, 0, ?)
+		 ON DUPLICATE KEY UPDATE user_id = user_id`,
+		userID, ip, now,
+	)
+	if err != nil {
+		return false, fmt.Errorf("insert login failures: %w", err)
+	}
+	var failures int
+	var lastStr string
+	var lockedStr sql.NullString
+	err = tx.QueryRow(
+		"SELECT failures, last_failure_at, locked_until FROM login_failures WHERE user_id = ? AND ip = ? FOR UPDATE",
+		userID, ip,
+	).Scan(&failures, &lastStr, &lockedStr)
+	if err != nil {
+		return false, fmt.Errorf("select login failures: %w", err)
+	}
+	last, err := parseDBTime(lastStr)
+	if err != nil {
+		return false, err
+	}
+	locked, err := parseNullDBTime(lockedStr)
+	if err != nil {
+		return false, err
+	}
+	if locked != nil && now.Before(*locked) {
+		return false, nil
+	}
+
+	if now.Sub(last) > loginFailureMemory {
+		failures = 0
+	}
+	failures++
+	var lockedUntil interface{}
+	if d := lockoutDuration(failures, accountFreeAttempts); d > 0 {
+		lockedUntil = now.Add(d)
+	}
+	_, err = tx.Exec(
+		"UPDATE login_failures SET failures = ?, last_failure_at = ?, locked_until = ? WHERE user_id = ? AND ip = ?",
+		failures, now, lockedUntil, userID, ip,
+	)
+	if err != nil {
+		return false, fmt.Errorf("update login failures: %w", err)
+	}
+
+	wait, ok, err := reserveAccountSlot(tx, userID, now)
+	if err != nil || !ok {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("commit: %w", err)
+	}
+	time.Sleep(wait)
+	return true, nil
+}
+
+// reserveAccountSlot counts a login attempt on an account across all IPs,
+// within the transaction of reserveAccountAttempt. It returns how long the
+// attempt has to wait for its turn, or false if that would be longer than
+// accountThrottleMaxWait.
+func reserveAccountSlot(tx *sql.Tx, userID int, now time.Time) (time.Duration, bool, error) {
+	var failures int
+	var lastStr, nextStr sql.NullString
+	err := tx.QueryRow(
+		"SELECT login_failures, last_login_failure_at, next_login_attempt_at FROM users WHERE user_id = ? FOR UPDATE",
+		userID,
+	).Scan(&failures, &lastStr, &nextStr)
+	if err != nil {
+		return 0, false, fmt.Errorf("select account login failures: %w", err)
+	}
+	last, err := parseNullDBTime(lastStr)
+	if err != nil {
+		return 0, false, err
+	}
+	next, err := parseNullDBTime(nextStr)
+	if err != nil {
+		return 0, false, err
+	}
+
+	if last == nil || now.Sub(*last) > loginFailureMemory {
+		failures = 0
+	}
+	failures++
+	slot := now
+	var nextAttempt interface{}
+	if failures > accountWideFreeAttempts {
+		if next != nil && next.After(slot) {
+			slot = *next
+		}
+		if slot.Sub(now) > accountThrottleMaxWait {
+			return 0, false, nil
+		}
+		d := accountThrottleBase
+		for i := accountWideFreeAttempts + 1; i < failures && d < accountThrottleMax; i++ {
+			d *= 2
+		}
+		if d > accountThrottleMax {
+			d = accountThrottleMax
+		}
+		nextAttempt = slot.Add(d)
+	}
+	_, err = tx.Exec(
+		"UPDATE users SET login_failures = ?, last_login_failure_at = ?, next_login_attempt_at = ? WHERE user_id = ?",
+		failures, now, nextAttempt, userID,
+	)
+	if err != nil {
+		return 0, false, fmt.Errorf("update account login failures: %w", err)
+	}
+	return slot.Sub(now), true, nil
+}
+
+// resetAccountFailures forgives the failed logins to an account from an IP,
+// and its failures across all IPs, after a successful one.
+func resetAccountFailures(userID int, ip string) error {
+	if _, err := db.Exec("DELETE FROM login_failures WHERE user_id = ? AND ip = ?", userID, truncate(ip, 45)); err != nil {
+		return fmt.Errorf("reset login failures: %w", err)
+	}
+	_, err := db.Exec(
+		"UPDATE users SET login_failures = 0, last_login_failure_at = NULL, next_login_attempt_at = NULL WHERE user_id = ? AND login_failures > 0",
+		userID,
+	)
+	if err != nil {
+		return fmt.Errorf("reset account login failures: %w", err)
+	}
+	return nil
+}
+
+// deleteStaleLoginFailures removes failed logins that are no longer
+// remembered. It is run by the retention job.
+func deleteStaleLoginFailures(now time.Time) error {
+	if _, err := db.Exec("DELETE FROM login_failures WHERE last_failure_at < ?", now.UTC().Add(-loginFailureMemory)); err != nil {
+		return fmt.Errorf("delete stale login failures: %w", err)
+	}
+	return nil
+}
+
+// writeLockedOut responds that logins from an IP are locked until a time.
+func writeLockedOut(w http.ResponseWriter, until, now time.Time) {
+	retryAfter := int(until.Sub(now).Seconds()) + 1
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	http.Error(w, fmt.Sprintf("too many failed login attempts, try again in %v", time.Duration(retryAfter)*time.Second), http.StatusTooManyRequests)
+}
@@ -14,12 +14,13 @@ import (
 
 var db *sql.DB
 var secCookie *securecookie.SecureCookie
-var pendingCommands map[string][]string
 
 type User struct {
-	UserID   int    `json:"user_id"`
-	Email    string `json:"email"`
-	Username string `json:"username"`
+	UserID        int    `json:"user_id"`
+	Email         string `json:"email"`
+	Username      string `json:"username"`
+	EmailVerified bool   `json:"email_verified"`
+	TOTPEnabled   bool   `json:"totp_enabled"`
 }
 
 func main() {
@@ -49,30 +50,99 @@ func main() {
 	blockKey := os.Getenv("POTBOT_BLOCK_KEY")
 	secCookie = securecookie.New([]byte(hashKey), []byte(blockKey))
 
-	// Initialize pendingCommands map for issuing commands to plants
-	pendingCommands = make(map[string][]string)
+	if err := loadSensorTypes(); err != nil {
+		log.Printf("could not load sensor types, using defaults: %v", err)
+	}
+
+	// Accepted window for device-supplied reading timestamps
+	maxClockSkew = envDuration("POTBOT_MAX_CLOCK_SKEW", maxClockSkew)
+	maxLogAge = envDuration("POTBOT_MAX_LOG_AGE", maxLogAge)
+
+	// Retention of plant readings
+	rawLogRetention = envDuration("POTBOT_RAW_LOG_RETENTION", rawLogRetention)
+	hourlyLogRetention = envDuration("POTBOT_HOURLY_LOG_RETENTION", hourlyLogRetention)
+	retentionInterval = envDuration("POTBOT_RETENTION_INTERVAL", retentionInterval)
+	plantOfflineAfter = envDuration("POTBOT_PLANT_OFFLINE_AFTER", plantOfflineAfter)
+	offlineCheckInterval = envDuration("POTBOT_OFFLINE_CHECK_INTERVAL", offlineCheckInterval)
+	sessionLifetime = envDuration("POTBOT_SESSION_LIFETIME", sessionLifetime)
+	passwordResetLifetime = envDuration("POTBOT_PASSWORD_RESET_LIFETIME", passwordResetLifetime)
+	emailVerificationLifetime = envDuration("POTBOT_EMAIL_VERIFICATION_LIFETIME", emailVerificationLifetime)
+	if v := os.Getenv("POTBOT_PUBLIC_URL"); v != "" {
+		publicURL = v
+	}
+
+	// Background jobs
+	go runScheduler()
+	go runRetention()
+	go runOfflineChecker()
+	go runOutboxWorker()
 
 	// creds
 	http.HandleFunc("/api/register", withCORS(handleRegister))
 	http.HandleFunc("/api/login", withCORS(handleLogin))
+	http.HandleFunc("/api/login_totp", withCORS(handleLoginTOTP))
 	http.HandleFunc("/api/logout", withCORS(handleLogout))
 	http.HandleFunc("/api/me", withCORS(handleMe))
+	http.HandleFunc("/api/get_sessions", withCORS(handleGetSessions))
+	http.HandleFunc("/api/revoke_session", withCORS(handleRevokeSession))
+	http.HandleFunc("/api/revoke_all_sessions", withCORS(handleRevokeAllSessions))
+	http.HandleFunc("/api/request_password_reset", withCORS(handleRequestPasswordReset))
+	http.HandleFunc("/api/confirm_password_reset", withCORS(handleConfirmPasswordReset))
+	http.HandleFunc("/api/confirm_email", withCORS(handleConfirmEmail))
+	http.HandleFunc("/api/resend_verification_email", withCORS(handleResendVerificationEmail))
+	http.HandleFunc("/api/enroll_totp", withCORS(handleEnrollTOTP))
+	http.HandleFunc("/api/activate_totp", withCORS(handleActivateTOTP))
+	http.HandleFunc("/api/disable_totp", withCORS(handleDisableTOTP))
 
 	// user
 	http.HandleFunc("/api/add_plant", withCORS(handleAddPlant))
 	http.HandleFunc("/api/issue_command", withCORS(handleIssueCommand))
+	http.HandleFunc("/api/get_command_status", withCORS(handleGetCommandStatus))
+	http.HandleFunc("/api/get_available_commands", withCORS(handleGetAvailableCommands))
 	http.HandleFunc("/api/get_all_my_plants", withCORS(handleGetAllMyPlants))
 	http.HandleFunc("/api/get_plant_logs", withCORS(handleGetPlantLogs))
+	http.HandleFunc("/api/export_plant_logs", withCORS(handleExportPlantLogs))
+	http.HandleFunc("/api/plant_events", withCORS(handlePlantEvents))
+	http.HandleFunc("/api/get_sensor_types", withCORS(handleGetSensorTypes))
+
+	// admin
+	http.HandleFunc("/api/add_sensor_type", withCORS(handleAddSensorType))
+
+	// schedules
+	http.HandleFunc("/api/create_schedule", withCORS(handleCreateSchedule))
+	http.HandleFunc("/api/get_schedules", withCORS(handleGetSchedules))
+	http.HandleFunc("/api/pause_schedule", withCORS(handlePauseSchedule))
+	http.HandleFunc("/api/delete_schedule", withCORS(handleDeleteSchedule))
+
+	// notifications
+	http.HandleFunc("/api/get_notification_preferences", withCORS(handleGetNotificationPreferences))
+	http.HandleFunc("/api/set_notification_preferences", withCORS(handleSetNotificationPreferences))
+	http.HandleFunc("/api/test_notification", withCORS(handleTestNotification))
+	http.HandleFunc("/api/get_notification_types", withCORS(handleGetNotificationTypes))
+	http.HandleFunc("/api/get_notifications", withCORS(handleGetNotifications))
+	http.HandleFunc("/api/mark_notifications_read", withCORS(handleMarkNotificationsRead))
+	http.HandleFunc("/api/get_unread_notification_count", withCORS(handleGetUnreadNotificationCount))
+	http.HandleFunc("/api/get_failed_notifications", withCORS(handleGetFailedNotifications))
+
+	// alert rules
+	http.HandleFunc("/api/create_alert_rule", withCORS(handleCreateAlertRule))
+	http.HandleFunc("/api/get_alert_rules", withCORS(handleGetAlertRules))
+	http.HandleFunc("/api/update_alert_rule", withCORS(handleUpdateAlertRule))
+	http.HandleFunc("/api/delete_alert_rule", withCORS(handleDeleteAlertRule))
 
 	// plant
 	http.HandleFunc("/api/verify_plant_creds", withCORS(handleVerifyPlantCreds))
 	http.HandleFunc("/api/plant_log", withCORS(handlePlantLog))
+	http.HandleFunc("/api/plant_log_batch", withCORS(handlePlantLogBatch))
 	http.HandleFunc("/api/fetch_commands", withCORS(handleFetchCommands))
+	http.HandleFunc("/api/ack_command", withCORS(handleAckCommand))
+	http.HandleFunc("/api/plant_ws", withCORS(handlePlantWebSocket))
 	http.HandleFunc("/api/plant_notify", withCORS(handlePlantNotify))
 
 	// utils
 	http.HandleFunc("/api/generate_plants", withCORS(handleGeneratePlants))
 	http.HandleFunc("/api/ping", withCORS(handlePing))
+	http.HandleFunc("/api/time_sync", withCORS(handleTimeSync))
 
 	// Serve frontend static if built into ./frontend/build
 	fs := http.FileServer(http.Dir("../frontend/build"))
@@ -0,0 +1,758 @@
+// `notifiers.go` contains the channels notifications can be delivered
+// through (email, webhooks and push services), and the per-user preference
+// that picks one
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/smtp"
+	"net/textproto"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Notification channels a user can choose from.
+const (
+	channelEmail   = "email"
+	channelWebhook = "webhook"
+	channelPush    = "push"
+)
+
+// Push services a push channel can talk to.
+const (
+	pushNtfy   = "ntfy"
+	pushGotify = "gotify"
+)
+
+// notifierTimeout bounds each delivery attempt over HTTP.
+const notifierTimeout = 10 * time.Second
+
+// notification is what gets delivered, whichever the channel.
+type notification struct {
+	NotificationID int64     `json:"notificationId"`
+	Type           string    `json:"type"`
+	Severity       string    `json:"severity"`
+	PlantID        string    `json:"plantId,omitempty"`
+	Subject        string    `json:"subject"`
+	Body           string    `json:"body"`
+	HTML           string    `json:"html,omitempty"`
+	CreatedAt      time.Time `json:"createdAt"`
+}
+
+// notifier delivers notifications over one channel.
+type notifier interface {
+	notify(n notification) error
+	// channel names the channel, for recording where a notification went.
+	channel() string
+}
+
+// smtpConfig is how to reach the mail server. Password may be empty for a
+// server that doesn't need authentication, such as a local test server.
+type smtpConfig struct {
+	From     string
+	Password string
+	Server   string
+	Port     string
+}
+
+// smtpConfigFromEnv reads the mail server settings from the `.env` file.
+func smtpConfigFromEnv() smtpConfig {
+	return smtpConfig{
+		From:     os.Getenv("POTBOT_EMAIL_ADDRESS"),
+		Password: os.Getenv("POTBOT_EMAIL_PASSWORD"),
+		Server:   os.Getenv("POTBOT_MAIL_SERVER"),
+		Port:     os.Getenv("POTBOT_MAIL_PORT"),
+	}
+}
+
+// send sends an email. If html is not empty the email is multipart, with
+// text as the plain-text alternative; otherwise it is plain text.
+func (c smtpConfig) send(to, subject, text, html string) error {
+	if c.From == "" || c.Server == "" || c.Port == "" {
+		return fmt.Errorf("email configuration not set in environment")
+	}
+
+	var auth smtp.Auth
+	if c.Password != "" {
+		auth = smtp.PlainAuth("", c.From, c.Password, c.Server)
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", c.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+
+	if html == "" {
+		msg.WriteString("Content-Type: text/plain; charset=\"utf-8\"\r\n")
+		msg.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+		if err := writeQuotedPrintable(&msg, text); err != nil {
+			return err
+		}
+	} else {
+		mw := multipart.NewWriter(&msg)
+		fmt.Fprintf(&msg, "Content-Type: multipart/alternative; boundary=%q\r\n\r\n", mw.Boundary())
+		// Clients show the last part they understand, so plain text goes first
+		for _, part := range []struct{ contentType, body string }{
+			{"text/plain", text},
+			{"text/html", html},
+		} {
+			pw, err := mw.CreatePart(textproto.MIMEHeader{
+				"Content-Type":              {part.contentType + "; charset=\"utf-8\""},
+				"Content-Transfer-Encoding": {"quoted-printable"},
+			})
+			if err != nil {
+				return err
+			}
+			if err := writeQuotedPrintable(pw, part.body); err != nil {
+				return err
+			}
+		}
+		if err := mw.Close(); err != nil {
+			return err
+		}
+	}
+
+	addr := c.Server + ":" + c.Port
+	return smtp.SendMail(addr, auth, c.From, []string{to}, msg.Bytes())
+}
+
+// writeQuotedPrintable writes s to w with quoted-printable encoding, which
+// keeps lines short and non-ASCII text intact through any mail server.
+func writeQuotedPrintable(w io.Writer, s string) error {
+	qw := quotedprintable.NewWriter(w)
+	if _, err := qw.Write([]byte(s)); err != nil {
+		return err
+	}
+	return qw.Close()
+}
+
+// smtpNotifier emails notifications to one address.
+type smtpNotifier struct {
+	config smtpConfig
+	to     string
+}
+
+func (s smtpNotifier) notify(n notification) error {
+	return s.config.send(s.to, n.Subject, n.Body, n.HTML)
+}
+
+func (s smtpNotifier) channel() string { return channelEmail }
+
+// webhookNotifier POSTs notifications as JSON to a URL of the user's choosing.
+// If a secret is set, the request carries an X-Potbot-Signature header of the
+// form "sha256=<hex>", the HMAC-SHA256 of the request body keyed with the
+// secret, so the receiver can check it came from us.
+type webhookNotifier struct {
+	client *http.Client
+	url    string
+	secret string
+}
+
+func (wh webhookNotifier) notify(n notification) error {
+	payload, err := json.Marshal(n)
+	if err != nil {
+		return fmt.Errorf("encode webhook payload: %w", err)
+	}
+	req, err := http.NewRequest("POST", wh.url, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("build webhook request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Potbot-Event", n.Type)
+	req.Header.Set("X-Potbot-Delivery", strconv.FormatInt(n.NotificationID, 10))
+	if wh.secret != "" {
+		req.Header.Set("X-Potbot-Signature", "sha256="+signWebhook(wh.secret, payload))
+	}
+	return doNotifierRequest(wh.client, req)
+}
+
+func (wh webhookNotifier) channel() string { return channelWebhook }
+
+// signWebhook returns the hex HMAC-SHA256 of payload keyed with secret.
+func signWebhook(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// pushNotifier sends notifications to a self-hostable push service:
+//   - ntfy:   url is the topic URL, e.g. https://ntfy.sh/my-plants; token, if
+//     set, is sent as a bearer token.
+//   - gotify: url is the server's base URL; token is an application token.
+type pushNotifier struct {
+	client *http.Client
+	kind   string
+	url    string
+	token  string
+}
+
+func (p pushNotifier) notify(n notification) error {
+	var req *http.Request
+	var err error
+	switch p.kind {
+	case pushNtfy:
+		req, err = http.NewRequest("POST", p.url, strings.NewReader(n.Body))
+		if err != nil {
+			return fmt.Errorf("build ntfy request: %w", err)
+		}
+		req.Header.Set("Title", n.Subject)
+		req.Header.Set("Tags", strings.ToLower(n.Type))
+		if p.token != "" {
+			req.Header.Set("Authorization", "Bearer "+p.token)
+		}
+	case pushGotify:
+		payload, _ := json.Marshal(map[string]interface{}{"title": n.Subject, "message": n.Body, "priority": 5})
+		req, err = http.NewRequest("POST", strings.TrimRight(p.url, "/")+"/message", bytes.NewReader(payload))
+		if err != nil {
+			return fmt.Errorf("build gotify request: %w", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Gotify-Key", p.token)
+	default:
+		return fmt.Errorf("unknown push service %q", p.kind)
+	}
+	return doNotifierRequest(p.client, req)
+}
+
+func (p pushNotifier) channel() string { return channelPush }
+
+// doNotifierRequest sends req and treats any non-2xx response as a failure.
+// The response body is only logged: errors end up in front of the user, and
+// the body of whatever their URL points at is none of their business.
+func doNotifierRequest(client *http.Client, req *http.Request) error {
+	req.Header.Set("User-Agent", "potbot-notifier")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		snippet, _ := io.ReadAll(io.LimitReader(resp.Body, 200))
+		log.Printf("notifier: %s responded %s: %s", req.URL.Host, resp.Status, strings.TrimSpace(string(snippet)))
+		return fmt.Errorf("%s responded %s", req.URL.Host, resp.Status)
+	}
+	return nil
+}
+
+// errNotifierDestination is returned when a webhook or push URL points at an
+// address notifiers may not connect to.
+var errNotifierDestination = errors.New("destination address not allowed")
+
+// cgnatPrefix is the shared address space of carrier-grade NAT (RFC 6598),
+// which netip doesn't count as private.
+var cgnatPrefix = netip.MustParsePrefix("100.64.0.0/10")
+
+// allowedNotifierAddr reports whether notifiers may connect to an address.
+// Webhook and push URLs are chosen by users, so anything that would reach
+// the server itself or its network is refused: loopback, private and
+// link-local addresses (including cloud metadata services) and the like.
+func allowedNotifierAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return addr.IsGlobalUnicast() && !addr.IsPrivate() && !cgnatPrefix.Contains(addr)
+}
+
+// checkNotifierDial is the dialer Control function of notifierHTTPClient. It
+// sees the address actually being connected to, after DNS resolution, so a
+// hostname can't be pointed at a forbidden address after the URL was
+// checked.
+func checkNotifierDial(network, address string, _ syscall.RawConn) error {
+	ap, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return fmt.Errorf("parse dial address %q: %w", address, err)
+	}
+	if !allowedNotifierAddr(ap.Addr()) {
+		return errNotifierDestination
+	}
+	return nil
+}
+
+// notifierHTTPClient is shared by the webhook and push notifiers. It doesn't
+// use a proxy from the environment, so every connection goes through
+// checkNotifierDial.
+var notifierHTTPClient = &http.Client{
+	Timeout: notifierTimeout,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: notifierTimeout,
+			Control: checkNotifierDial,
+		}).DialContext,
+		ForceAttemptHTTP2:   true,
+		TLSHandshakeTimeout: notifierTimeout,
+		MaxIdleConns:        10,
+		IdleConnTimeout:     90 * time.Second,
+	},
+}
+
+// defaultDedupeWindow is the dedupe window of users who haven't chosen one.
+const defaultDedupeWindow = 10 * time.Minute
+
+// maxDedupeWindow bounds the dedupe window a user may choose.
+const maxDedupeWindow = 7 * 24 * time.Hour
+
+// NotificationPreferences is a user's choice of channel and its settings, and
+// which notifications they want:
+//   - MutedTypes are notification types they don't want at all.
+//   - Between QuietStart and QuietEnd ("HH:MM" in TimeZone) only critical
+//     notifications are sent; others are held until QuietEnd. The range may
+//     wrap past midnight; it is off when both are empty.
+//   - A notification of the same type about the same plant as one sent less
+//     than DedupeWindow ago is not sent again.
+//
+// Secrets are never sent back to the client; hasWebhookSecret and
+// hasPushToken say whether one is set.
+type NotificationPreferences struct {
+	Channel          string   `json:"channel"`
+	WebhookURL       string   `json:"webhookUrl,omitempty"`
+	WebhookSecret    string   `json:"-"`
+	HasWebhookSecret bool     `json:"hasWebhookSecret"`
+	PushKind         string   `json:"pushKind,omitempty"`
+	PushURL          string   `json:"pushUrl,omitempty"`
+	PushToken        string   `json:"-"`
+	HasPushToken     bool     `json:"hasPushToken"`
+	MutedTypes       []string `json:"mutedTypes"`
+	QuietStart       string   `json:"quietStart,omitempty"`
+	QuietEnd         string   `json:"quietEnd,omitempty"`
+	TimeZone         string   `json:"timeZone"`
+	DedupeWindow     string   `json:"dedupeWindow"`
+}
+
+// loadNotificationPreferences returns a user's preferences, defaulting to
+// email and no filtering other than the default dedupe window for users who
+// haven't set any.
+func loadNotificationPreferences(userID int) (NotificationPreferences, error) {
+	p := NotificationPreferences{
+		Channel:      channelEmail,
+		MutedTypes:   []string{},
+		TimeZone:     "UTC",
+		DedupeWindow: defaultDedupeWindow.String(),
+	}
+	var webhookURL, webhookSecret, pushKind, pushURL, pushToken, mutedTypes, quietStart, quietEnd sql.NullString
+	err := db.QueryRow(
+		`SELECT channel, webhook_url, webhook_secret, push_kind, push_url, push_token,
+		        muted_types, quiet_start, quiet_end, time_zone, dedupe_window
+		 FROM notification_preferences WHERE user_id = ?`,
+		userID,
+	).Scan(&p.Channel, &webhookURL, &webhookSecret, &pushKind, &pushURL, &pushToken,
+		&mutedTypes, &quietStart, &quietEnd, &p.TimeZone, &p.DedupeWindow)
+	if err == sql.ErrNoRows {
+		return p, nil
+	} else if err != nil {
+		return p, fmt.Errorf("select notification preferences: %w", err)
+	}
+	p.WebhookURL, p.WebhookSecret = webhookURL.String, webhookSecret.String
+	p.PushKind, p.PushURL, p.PushToken = pushKind.String, pushURL.String, pushToken.String
+	p.HasWebhookSecret, p.HasPushToken = p.WebhookSecret != "", p.PushToken != ""
+	p.QuietStart, p.QuietEnd = quietStart.String, quietEnd.String
+	if mutedTypes.String != "" {
+		if err := json.Unmarshal([]byte(mutedTypes.String), &p.MutedTypes); err != nil {
+			log.Printf("Error decoding muted notification types of user %d: %v", userID, err)
+		}
+	}
+	return p, nil
+}
+
+// muted reports whether the user doesn't want notifications of a type.
+func (p NotificationPreferences) muted(notificationType string) bool {
+	for _, t := range p.MutedTypes {
+		if t == notificationType {
+			return true
+		}
+	}
+	return false
+}
+
+// quietHoursEnd reports whether t falls in the user's quiet hours and, if it
+// does, when they end.
+func (p NotificationPreferences) quietHoursEnd(t time.Time) (time.Time, bool) {
+	if p.QuietStart == "" || p.QuietEnd == "" {
+		return time.Time{}, false
+	}
+	start, err1 := parseClock(p.QuietStart)
+	end, err2 := parseClock(p.QuietEnd)
+	loc, err3 := time.LoadLocation(p.TimeZone)
+	if err1 != nil || err2 != nil || err3 != nil || start == end {
+		return time.Time{}, false
+	}
+	local := t.In(loc)
+	now := local.Hour()*60 + local.Minute()
+	if start < end && (now < start || now >= end) {
+		return time.Time{}, false
+	}
+	if start > end && now < start && now >= end {
+		return time.Time{}, false
+	}
+	// The quiet hours end at the next time the clock shows QuietEnd
+	y, m, d := local.Date()
+	until := time.Date(y, m, d, end/60, end%60, 0, 0, loc)
+	if !until.After(local) {
+		until = time.Date(y, m, d+1, end/60, end%60, 0, 0, loc)
+	}
+	return until.UTC(), true
+}
+
+// dedupeWindow returns the user's dedupe window.
+func (p NotificationPreferences) dedupeWindow() time.Duration {
+	d, err := time.ParseDuration(p.DedupeWindow)
+	if err != nil {
+		return defaultDedupeWindow
+	}
+	return d
+}
+
+// parseClock parses "HH:MM" into minutes after midnight.
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q, expected HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// notifier builds the notifier for the preferences. email is the user's
+// address, used by the email channel.
+func (p NotificationPreferences) notifier(email string) (notifier, error) {
+	switch p.Channel {
+	case channelEmail, "":
+		return smtpNotifier{config: smtpConfigFromEnv(), to: email}, nil
+	case channelWebhook:
+		return webhookNotifier{client: notifierHTTPClient, url: p.WebhookURL, secret: p.WebhookSecret}, nil
+	case channelPush:
+		return pushNotifier{client: notifierHTTPClient, kind: p.PushKind, url: p.PushURL, token: p.PushToken}, nil
+	}
+	return nil, fmt.Errorf("unknown notification channel %q", p.Channel)
+}
+
+// validate checks preferences submitted by a user.
+func (p NotificationPreferences) validate() error {
+	switch p.Channel {
+	case channelEmail:
+	case channelWebhook:
+		if err := validateNotifierURL(p.WebhookURL); err != nil {
+			return fmt.Errorf("webhookUrl: %w", err)
+		}
+	case channelPush:
+		if p.PushKind != pushNtfy && p.PushKind != pushGotify {
+			return fmt.Errorf("pushKind must be %q or %q", pushNtfy, pushGotify)
+		}
+		if err := validateNotifierURL(p.PushURL); err != nil {
+			return fmt.Errorf("pushUrl: %w", err)
+		}
+		if p.PushKind == pushGotify && p.PushToken == "" {
+			return fmt.Errorf("pushToken is required for gotify")
+		}
+	default:
+		return fmt.Errorf("channel must be %q, %q or %q", channelEmail, channelWebhook, channelPush)
+	}
+
+	for _, t := range p.MutedTypes {
+		if !notificationTypeRe.MatchString(t) {
+			return fmt.Errorf("invalid notification type %q in mutedTypes", t)
+		}
+	}
+	if (p.QuietStart == "") != (p.QuietEnd == "") {
+		return fmt.Errorf("quietStart and quietEnd must be set together")
+	}
+	if p.QuietStart != "" {
+		if _, err := parseClock(p.QuietStart); err != nil {
+			return fmt.Errorf("quietStart: %w", err)
+		}
+		if _, err := parseClock(p.QuietEnd); err != nil {
+			return fmt.Errorf("quietEnd: %w", err)
+		}
+	}
+	if _, err := time.LoadLocation(p.TimeZone); err != nil || p.TimeZone == "" {
+		return fmt.Errorf("invalid time zone %q", p.TimeZone)
+	}
+	if d, err := time.ParseDuration(p.DedupeWindow); err != nil || d < 0 || d > maxDedupeWindow {
+		return fmt.Errorf("dedupeWindow must be a duration between 0s and %v", maxDedupeWindow)
+	}
+	return nil
+}
+
+// validateNotifierURL checks a webhook or push URL. A host given as an IP
+// address is checked here, so the user learns about it when saving rather
+// than when a notification fails; hostnames are checked as they are dialed.
+func validateNotifierURL(s string) error {
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("must be an http or https URL")
+	}
+	addr, err := netip.ParseAddr(u.Hostname())
+	if (err == nil && !allowedNotifierAddr(addr)) || strings.EqualFold(u.Hostname(), "localhost") {
+		return fmt.Errorf("must not point at a private or local address")
+	}
+	return nil
+}
+
+// userNotifier returns the notifier a user has chosen.
+func userNotifier(userID int, email string) (notifier, error) {
+	prefs, err := loadNotificationPreferences(userID)
+	if err != nil {
+		return nil, err
+	}
+	return prefs.notifier(email)
+}
+
+// handleGetNotificationPreferences returns the logged in user's notification
+// preferences.
+func handleGetNotificationPreferences(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, ok := getSessionUserID(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	prefs, err := loadNotificationPreferences(userID)
+	if err != nil {
+		log.Printf("Error loading notification preferences: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(prefs)
+}
+
+// Request body for setting notification preferences. The channel settings
+// are only changed when channel is given. The other fields, including the
+// secrets, are kept as they are when omitted; the secrets are cleared when set
+// to "".
+type setNotificationPreferencesRequest struct {
+	Channel       string    `json:"channel"`
+	WebhookURL    string    `json:"webhookUrl"`
+	WebhookSecret *string   `json:"webhookSecret"`
+	PushKind      string    `json:"pushKind"`
+	PushURL       string    `json:"pushUrl"`
+	PushToken     *string   `json:"pushToken"`
+	MutedTypes    *[]string `json:"mutedTypes"`
+	QuietStart    *string   `json:"quietStart"`
+	QuietEnd      *string   `json:"quietEnd"`
+	TimeZone      *string   `json:"timeZone"`
+	DedupeWindow  *string   `json:"dedupeWindow"`
+}
+
+// handleSetNotificationPreferences sets how the logged in user is notified.
+// Expects POST JSON body:
+//
+//	{
+//	    "channel": "email" | "webhook" | "push",
+//	    "webhookUrl": "https://...",       // for webhook
+//	    "webhookSecret": "string",         // for webhook, optional
+//	    "pushKind": "ntfy" | "gotify",     // for push
+//	    "pushUrl": "https://ntfy.sh/...",  // for push
+//	    "pushToken": "string",             // for push, required for gotify
+//	    "mutedTypes": ["OFFLINE"],         // types not to be notified of
+//	    "quietStart": "22:00",             // quiet hours, "" to turn off
+//	    "quietEnd": "07:00",
+//	    "timeZone": "America/Los_Angeles", // for the quiet hours
+//	    "dedupeWindow": "30m"              // "0s" to turn off
+//	}
+func handleSetNotificationPreferences(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, ok := getSessionUserID(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req setNotificationPreferencesRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	prefs, err := loadNotificationPreferences(userID)
+	if err != nil {
+		log.Printf("Error loading notification preferences: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if req.Channel != "" {
+		prefs.Channel, prefs.WebhookURL, prefs.PushKind, prefs.PushURL = req.Channel, req.WebhookURL, req.PushKind, req.PushURL
+	}
+	if req.MutedTypes != nil {
+		prefs.MutedTypes = *req.MutedTypes
+	}
+	if req.QuietStart != nil {
+		prefs.QuietStart = *req.QuietStart
+	}
+	if req.QuietEnd != nil {
+		prefs.QuietEnd = *req.QuietEnd
+	}
+	if req.TimeZone != nil {
+		prefs.TimeZone = *req.TimeZone
+	}
+	if req.DedupeWindow != nil {
+		prefs.DedupeWindow = *req.DedupeWindow
+	}
+	if req.WebhookSecret != nil {
+		prefs.WebhookSecret = *req.WebhookSecret
+	}
+	if req.PushToken != nil {
+		prefs.PushToken = *req.PushToken
+	}
+	prefs.HasWebhookSecret, prefs.HasPushToken = prefs.WebhookSecret != "", prefs.PushToken != ""
+
+	if err := prefs.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if prefs.MutedTypes == nil {
+		prefs.MutedTypes = []string{}
+	}
+	mutedTypes, err := json.Marshal(prefs.MutedTypes)
+	if err != nil {
+		log.Printf("Error encoding muted notification types: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	_, err = db.Exec(
+		`INSERT INTO notification_preferences (user_id, channel, webhook_url, webhook_secret, push_kind, push_url, push_token,
+		   muted_types, quiet_start, quiet_end, time_zone, dedupe_window)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		 ON DUPLICATE KEY UPDATE channel = VALUES(channel), webhook_url = VALUES(webhook_url), webhook_secret = VALUES(webhook_secret),
+		   push_kind = VALUES(push_kind), push_url = VALUES(push_url), push_token = VALUES(push_token),
+		   muted_types = VALUES(muted_types), quiet_start = VALUES(quiet_start), quiet_end = VALUES(quiet_end),
+		   time_zone = VALUES(time_zone), dedupe_window = VALUES(dedupe_window)`,
+		userID, prefs.Channel, nullableString(prefs.WebhookURL), nullableString(prefs.WebhookSecret),
+		nullableString(prefs.PushKind), nullableString(prefs.PushURL), nullableString(prefs.PushToken),
+		string(mutedTypes), nullableString(prefs.QuietStart), nullableString(prefs.QuietEnd), prefs.TimeZone, prefs.DedupeWindow,
+	)
+	if err != nil {
+		log.Printf("Error saving notification preferences: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(prefs)
+}
+
+// testNotificationInterval is how often a user can send a test notification,
+// so the endpoint can't be used to flood a mail server or someone's URL.
+const testNotificationInterval = time.Minute
+
+// testNotificationThrottle remembers when each user last sent a test
+// notification. It is safe for concurrent use.
+type testNotificationThrottle struct {
+	mu   sync.Mutex
+	sent map[int]time.Time
+}
+
+var testNotificationsSent = &testNotificationThrottle{sent: make(map[int]time.Time)}
+
+// reserve records a test notification by a user, unless they sent one less
+// than testNotificationInterval ago. Then it returns when they may send the
+// next.
+func (t *testNotificationThrottle) reserve(userID int, now time.Time) (time.Time, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if next := t.sent[userID].Add(testNotificationInterval); now.Before(next) {
+		return next, false
+	}
+	for id, sent := range t.sent {
+		if now.Sub(sent) >= testNotificationInterval {
+			delete(t.sent, id)
+		}
+	}
+	t.sent[userID] = now
+	return time.Time{}, true
+}
+
+// handleTestNotification sends a test notification to the logged in user
+// through their chosen channel right away, bypassing the outbox, and reports
+// whether it was delivered. Useful when setting up a webhook or push server.
+// A user can send one every testNotificationInterval.
+func handleTestNotification(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, ok := getSessionUserID(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var email string
+	var username sql.NullString
+	var verified bool
+	if err := db.QueryRow("SELECT email, username, email_verified FROM users WHERE user_id = ?", userID).Scan(&email, &username, &verified); err != nil {
+		log.Printf("Error looking up user email: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	nt, err := userNotifier(userID, email)
+	if err != nil {
+		log.Printf("Error building notifier: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if nt.channel() == channelEmail && !verified {
+		http.Error(w, "verify your email address first", http.StatusConflict)
+		return
+	}
+	now := time.Now().UTC()
+	if next, ok := testNotificationsSent.reserve(userID, now); !ok {
+		retryAfter := int(next.Sub(now).Seconds()) + 1
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		http.Error(w, fmt.Sprintf("a test notification was sent less than %v ago", testNotificationInterval), http.StatusTooManyRequests)
+		return
+	}
+
+	msg, err := renderNotification(notificationData{Type: "TEST", Username: username.String})
+	if err != nil {
+		log.Printf("Error rendering test notification: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	err = nt.notify(notification{
+		Type:      "TEST",
+		Severity:  msg.Severity,
+		Subject:   msg.Subject,
+		Body:      msg.Text,
+		HTML:      msg.HTML,
+		CreatedAt: now,
+	})
+	resp := map[string]interface{}{"channel": nt.channel(), "delivered": err == nil}
+	if err != nil {
+		resp["error"] = err.Error()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
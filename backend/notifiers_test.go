@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+// capturedRequest is what a stand-in webhook or push server received.
+type capturedRequest struct {
+	method string
+	path   string
+	header http.Header
+	body   []byte
+}
+
+// newCaptureServer starts a server that records the one request it expects
+// and responds with status.
+func newCaptureServer(t *testing.T, status int) (*httptest.Server, <-chan capturedRequest) {
+	t.Helper()
+	got := make(chan capturedRequest, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		got <- capturedRequest{method: r.Method, path: r.URL.Path, header: r.Header.Clone(), body: body}
+		w.WriteHeader(status)
+		io.WriteString(w, "upstream says: internal detail")
+	}))
+	t.Cleanup(srv.Close)
+	return srv, got
+}
+
+func testNotification() notification {
+	return notification{
+		NotificationID: 42,
+		Type:           "LOW_MOISTURE",
+		Severity:       "warning",
+		PlantID:        "plant-1",
+		Subject:        "Basil is thirsty",
+		Body:           "Moisture is at 12%.",
+		CreatedAt:      time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+	}
+}
+
+func TestWebhookNotifierSignsPayload(t *testing.T) {
+	srv, got := newCaptureServer(t, http.StatusNoContent)
+	wh := webhookNotifier{client: srv.Client(), url: srv.URL + "/hook", secret: "s3cret"}
+
+	if err := wh.notify(testNotification()); err != nil {
+		t.Fatalf("notify: %v", err)
+	}
+	req := <-got
+
+	if req.method != "POST" || req.path != "/hook" {
+		t.Errorf("got %s %s, want POST /hook", req.method, req.path)
+	}
+	if ct := req.header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", ct)
+	}
+	if ev := req.header.Get("X-Potbot-Event"); ev != "LOW_MOISTURE" {
+		t.Errorf("X-Potbot-Event = %q, want LOW_MOISTURE", ev)
+	}
+	if id := req.header.Get("X-Potbot-Delivery"); id != "42" {
+		t.Errorf("X-Potbot-Delivery = %q, want 42", id)
+	}
+
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write(req.body)
+	want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if sig := req.header.Get("X-Potbot-Signature"); sig != want {
+		t.Errorf("X-Potbot-Signature = %q, want %q", sig, want)
+	}
+
+	var payload notification
+	if err := json.Unmarshal(req.body, &payload); err != nil {
+		t.Fatalf("decode payload: %v", err)
+	}
+	if payload.Subject != "Basil is thirsty" || payload.PlantID != "plant-1" {
+		t.Errorf("payload = %+v", payload)
+	}
+}
+
+func TestWebhookNotifierWithoutSecret(t *testing.T) {
+	srv, got := newCaptureServer(t, http.StatusOK)
+	wh := webhookNotifier{client: srv.Client(), url: srv.URL}
+
+	if err := wh.notify(testNotification()); err != nil {
+		t.Fatalf("notify: %v", err)
+	}
+	if sig := (<-got).header.Get("X-Potbot-Signature"); sig != "" {
+		t.Errorf("X-Potbot-Signature = %q, want none", sig)
+	}
+}
+
+func TestPushNotifierNtfy(t *testing.T) {
+	srv, got := newCaptureServer(t, http.StatusOK)
+	p := pushNotifier{client: srv.Client(), kind: pushNtfy, url: srv.URL + "/my-plants", token: "tk_abc"}
+
+	if err := p.notify(testNotification()); err != nil {
+		t.Fatalf("notify: %v", err)
+	}
+	req := <-got
+
+	if req.method != "POST" || req.path != "/my-plants" {
+		t.Errorf("got %s %s, want POST /my-plants", req.method, req.path)
+	}
+	if string(req.body) != "Moisture is at 12%." {
+		t.Errorf("body = %q", req.body)
+	}
+	for header, want := range map[string]string{
+		"Title":         "Basil is thirsty",
+		"Tags":          "low_moisture",
+		"Authorization": "Bearer tk_abc",
+	} {
+		if v := req.header.Get(header); v != want {
+			t.Errorf("%s = %q, want %q", header, v, want)
+		}
+	}
+}
+
+func TestPushNotifierGotify(t *testing.T) {
+	srv, got := newCaptureServer(t, http.StatusOK)
+	p := pushNotifier{client: srv.Client(), kind: pushGotify, url: srv.URL + "/", token: "app-token"}
+
+	if err := p.notify(testNotification()); err != nil {
+		t.Fatalf("notify: %v", err)
+	}
+	req := <-got
+
+	if req.method != "POST" || req.path != "/message" {
+		t.Errorf("got %s %s, want POST /message", req.method, req.path)
+	}
+	if key := req.header.Get("X-Gotify-Key"); key != "app-token" {
+		t.Errorf("X-Gotify-Key = %q, want app-token", key)
+	}
+	var payload struct {
+		Title    string `json:"title"`
+		Message  string `json:"message"`
+		Priority int    `json:"priority"`
+	}
+	if err := json.Unmarshal(req.body, &payload); err != nil {
+		t.Fatalf("decode payload: %v", err)
+	}
+	if payload.Title != "Basil is thirsty" || payload.Message != "Moisture is at 12%." || payload.Priority != 5 {
+		t.Errorf("payload = %+v", payload)
+	}
+}
+
+func TestNotifierErrorLeavesOutResponseBody(t *testing.T) {
+	srv, _ := newCaptureServer(t, http.StatusInternalServerError)
+	wh := webhookNotifier{client: srv.Client(), url: srv.URL}
+
+	err := wh.notify(testNotification())
+	if err == nil {
+		t.Fatal("notify succeeded on a 500 response")
+	}
+	if strings.Contains(err.Error(), "internal detail") {
+		t.Errorf("error %q includes the response body", err)
+	}
+}
+
+func TestNotifierHTTPClientRefusesLoopback(t *testing.T) {
+	srv, _ := newCaptureServer(t, http.StatusOK)
+
+	_, err := notifierHTTPClient.Get(srv.URL)
+	if !errors.Is(err, errNotifierDestination) {
+		t.Errorf("got error %v, want %v", err, errNotifierDestination)
+	}
+}
+
+func TestValidateNotifierURL(t *testing.T) {
+	for _, tc := range []struct {
+		url string
+		ok  bool
+	}{
+		{"https://ntfy.sh/my-plants", true},
+		{"http://example.com:8080/hook", true},
+		{"https://8.8.8.8/hook", true},
+		{"ftp://example.com/hook", false},
+		{"https://", false},
+		{"http://localhost:8080/hook", false},
+		{"http://127.0.0.1/hook", false},
+		{"http://10.1.2.3/hook", false},
+		{"http://192.168.1.10/hook", false},
+		{"http://169.254.169.254/latest/meta-data", false},
+		{"http://100.64.0.1/hook", false},
+		{"http://[::1]/hook", false},
+		{"http://[fd00::1]/hook", false},
+		{"http://[::ffff:127.0.0.1]/hook", false},
+		{"http://0.0.0.0/hook", false},
+	} {
+		err := validateNotifierURL(tc.url)
+		if (err == nil) != tc.ok {
+			t.Errorf("validateNotifierURL(%q) = %v, want ok=%v", tc.url, err, tc.ok)
+		}
+	}
+}
+
+// fakeSMTPServer accepts one connection, speaks just enough SMTP to take a
+// message, and sends what it received on the returned channel.
+func fakeSMTPServer(t *testing.T) (host, port string, msgs <-chan string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	out := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		tp := textproto.NewConn(conn)
+		tp.PrintfLine("220 localhost ESMTP")
+		for {
+			line, err := tp.ReadLine()
+			if err != nil {
+				return
+			}
+			switch cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0]); cmd {
+			case "EHLO", "HELO", "MAIL", "RCPT", "RSET", "NOOP":
+				tp.PrintfLine("250 OK")
+			case "DATA":
+				tp.PrintfLine("354 go ahead")
+				data, err := tp.ReadDotBytes()
+				if err != nil {
+					return
+				}
+				out <- string(data)
+				tp.PrintfLine("250 queued")
+			case "QUIT":
+				tp.PrintfLine("221 bye")
+				return
+			default:
+				tp.PrintfLine("502 unknown command %s", cmd)
+			}
+		}
+	}()
+
+	host, port, _ = net.SplitHostPort(ln.Addr().String())
+	return host, port, out
+}
+
+func TestSMTPConfigSendMultipart(t *testing.T) {
+	host, port, msgs := fakeSMTPServer(t)
+	c := smtpConfig{From: "potbot@example.com", Server: host, Port: port}
+
+	if err := c.send("user@example.com", "Basil is thirsty", "Moisture is at 12%.", "<p>Moisture is at <b>12%</b>.</p>"); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	msg, err := mail.ReadMessage(bufio.NewReader(strings.NewReader(<-msgs)))
+	if err != nil {
+		t.Fatalf("parse message: %v", err)
+	}
+
+	if from := msg.Header.Get("From"); from != "potbot@example.com" {
+		t.Errorf("From = %q", from)
+	}
+	if to := msg.Header.Get("To"); to != "user@example.com" {
+		t.Errorf("To = %q", to)
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil || subject != "Basil is thirsty" {
+		t.Errorf("Subject = %q (%v)", subject, err)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("Content-Type = %q (%v)", msg.Header.Get("Content-Type"), err)
+	}
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	var parts []string
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("read part: %v", err)
+		}
+		// multipart.Reader decodes quoted-printable parts itself
+		body, _ := io.ReadAll(p)
+		ct, _, _ := mime.ParseMediaType(p.Header.Get("Content-Type"))
+		parts = append(parts, ct+": "+string(body))
+	}
+	want := []string{
+		"text/plain: Moisture is at 12%.",
+		"text/html: <p>Moisture is at <b>12%</b>.</p>",
+	}
+	if strings.Join(parts, "\n") != strings.Join(want, "\n") {
+		t.Errorf("parts = %q, want %q", parts, want)
+	}
+}
+
+func TestSMTPConfigSendPlainText(t *testing.T) {
+	host, port, msgs := fakeSMTPServer(t)
+	c := smtpConfig{From: "potbot@example.com", Server: host, Port: port}
+
+	if err := c.send("user@example.com", "Grüße", "Größe: 5 cm", ""); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	msg, err := mail.ReadMessage(bufio.NewReader(strings.NewReader(<-msgs)))
+	if err != nil {
+		t.Fatalf("parse message: %v", err)
+	}
+	if ct := msg.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("Content-Type = %q, want text/plain", ct)
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil || subject != "Grüße" {
+		t.Errorf("Subject = %q (%v)", subject, err)
+	}
+	// The SMTP client ends the message with a line break before the final "."
+	body, _ := io.ReadAll(quotedprintable.NewReader(msg.Body))
+	if strings.TrimSuffix(string(body), "\n") != "Größe: 5 cm" {
+		t.Errorf("body = %q", body)
+	}
+}
+
+func TestSMTPConfigSendRequiresConfig(t *testing.T) {
+	if err := (smtpConfig{}).send("user@example.com", "s", "t", ""); err == nil {
+		t.Error("send succeeded without a mail server configured")
+	}
+}
@@ -0,0 +1,254 @@
+// `notifytypes.go` contains the catalog of notification types and the
+// templates their messages are rendered from
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	htemplate "html/template"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	ttemplate "text/template"
+	"time"
+)
+
+// How urgent a notification is.
+const (
+	severityInfo     = "info"
+	severityWarning  = "warning"
+	severityCritical = "critical"
+)
+
+// notificationKind describes one type of notification and how to word it.
+// The templates are executed with a notificationData. Internal types are only
+// sent by the server itself, whose templates rely on Extra values a plant
+// can't supply.
+type notificationKind struct {
+	Name        string `json:"name"`
+	Severity    string `json:"severity"`
+	Description string `json:"description"`
+	Internal    bool   `json:"internal"`
+
+	subject *ttemplate.Template
+	text    *ttemplate.Template
+	html    *htemplate.Template
+}
+
+// notificationData is what notification templates can refer to. Extra holds
+// values specific to the type, e.g. the rule that fired for an ALERT.
+type notificationData struct {
+	Type      string
+	PlantID   string
+	PlantName string
+	PlantType string
+	Username  string
+	Readings  []latestReading
+	Extra     map[string]interface{}
+}
+
+// latestReading is the most recent reading of one sensor type.
+type latestReading struct {
+	LogType     string
+	DisplayName string
+	Value       float64
+	Unit        string
+	Time        time.Time
+}
+
+// The latest readings are appended to every message, as a list in plain text
+// and a table in HTML.
+const (
+	textReadingsFooter = `{{if .Readings}}
+
+Latest readings:
+{{range .Readings}}  {{.DisplayName}}: {{.Value}}{{.Unit}} ({{.Time.Format "Jan 2 15:04 MST"}})
+{{end}}{{end}}`
+
+	htmlLayoutStart = `<!DOCTYPE html><html><body style="font-family: sans-serif; color: #222;">`
+
+	htmlReadingsFooter = `{{if .Readings}}<h4>Latest readings</h4>
+<table cellpadding="4" style="border-collapse: collapse;">
+{{range .Readings}}<tr><td>{{.DisplayName}}</td><td><b>{{.Value}}{{.Unit}}</b></td><td style="color: #888;">{{.Time.Format "Jan 2 15:04 MST"}}</td></tr>
+{{end}}</table>{{end}}
+<p style="color: #888; font-size: small;">Sent by Potbot. You can change how you are notified in your settings.</p>
+</body></html>`
+)
+
+// newNotificationKind parses a kind's templates. It panics on a bad template,
+// since the catalog is fixed at compile time.
+func newNotificationKind(name, severity, description, subject, text, html string) notificationKind {
+	return notificationKind{
+		Name:        name,
+		Severity:    severity,
+		Description: description,
+		subject:     ttemplate.Must(ttemplate.New(name + " subject").Parse(subject)),
+		text:        ttemplate.Must(ttemplate.New(name + " text").Parse(text + textReadingsFooter)),
+		html:        htemplate.Must(htemplate.New(name + " html").Parse(htmlLayoutStart + html + htmlReadingsFooter)),
+	}
+}
+
+// internalKind marks a kind as only sent by the server.
+func internalKind(k notificationKind) notificationKind {
+	k.Internal = true
+	return k
+}
+
+// genericNotificationKind is used for types a plant sends that aren't in the
+// catalog.
+var genericNotificationKind = newNotificationKind(
+	"", severityInfo, "A notification sent by a plant",
+	`{{.PlantName}}: {{.Type}}`,
+	`Hi {{or .Username "there"}} — your plant {{.PlantName}} sent a notification: {{.Type}}.`,
+	`<p>Hi {{or .Username "there"}},</p><p>Your plant <b>{{.PlantName}}</b> sent a notification: <b>{{.Type}}</b>.</p>`,
+)
+
+// notificationKinds is the catalog of known notification types.
+var notificationKinds = map[string]notificationKind{
+	"FALLEN": newNotificationKind(
+		"FALLEN", severityCritical, "The plant's pot has tipped over",
+		`{{.PlantName}} has fallen over`,
+		`Hi {{or .Username "there"}} — your {{with .PlantType}}{{.}} {{end}}plant {{.PlantName}} appears to have fallen over. Please check on it.`,
+		`<p>Hi {{or .Username "there"}},</p><p>Your {{with .PlantType}}{{.}} {{end}}plant <b>{{.PlantName}}</b> appears to have <b>fallen over</b>. Please check on it.</p>`,
+	),
+	"ALERT": internalKind(newNotificationKind(
+		"ALERT", severityWarning, "A reading crossed the threshold of one of your alert rules",
+		`{{.PlantName}}: {{.Extra.DisplayName}} is {{.Extra.Comparison}} {{.Extra.Threshold}}{{.Extra.Unit}}`,
+		`Hi {{or .Username "there"}} — the {{.Extra.DisplayName}} of your plant {{.PlantName}} is {{.Extra.Value}}{{.Extra.Unit}}, {{.Extra.Comparison}} your alert threshold of {{.Extra.Threshold}}{{.Extra.Unit}}{{with .Extra.Duration}} and has been for at least {{.}}{{end}}. You won't be alerted again until it recovers.`,
+		`<p>Hi {{or .Username "there"}},</p><p>The {{.Extra.DisplayName}} of your plant <b>{{.PlantName}}</b> is <b>{{.Extra.Value}}{{.Extra.Unit}}</b>, {{.Extra.Comparison}} your alert threshold of {{.Extra.Threshold}}{{.Extra.Unit}}{{with .Extra.Duration}} and has been for at least {{.}}{{end}}.</p><p>You won't be alerted again until it recovers.</p>`,
+	)),
+	"OFFLINE": internalKind(newNotificationKind(
+		"OFFLINE", severityWarning, "The plant hasn't been heard from for a while",
+		`{{.PlantName}} is offline`,
+		`Hi {{or .Username "there"}} — your plant {{.PlantName}} hasn't been heard from since {{.Extra.LastSeen.Format "2006-01-02 15:04 MST"}}. Please check that it has power and a network connection.`,
+		`<p>Hi {{or .Username "there"}},</p><p>Your plant <b>{{.PlantName}}</b> hasn't been heard from since {{.Extra.LastSeen.Format "2006-01-02 15:04 MST"}}. Please check that it has power and a network connection.</p>`,
+	)),
+	"TEST": internalKind(newNotificationKind(
+		"TEST", severityInfo, "A test of your notification settings",
+		`Potbot test notification`,
+		`Hi {{or .Username "there"}} — if you can read this, Potbot notifications are set up correctly.`,
+		`<p>Hi {{or .Username "there"}},</p><p>If you can read this, Potbot notifications are set up correctly.</p>`,
+	)),
+}
+
+// notificationTypeRe is what a notification type sent by a plant must look like.
+var notificationTypeRe = regexp.MustCompile(`^[A-Z][A-Z0-9_]{0,49}$`)
+
+// getNotificationKind returns the catalog entry for a type, or the generic one.
+func getNotificationKind(name string) notificationKind {
+	if k, ok := notificationKinds[name]; ok {
+		return k
+	}
+	return genericNotificationKind
+}
+
+// renderedNotification is a notification ready to be delivered.
+type renderedNotification struct {
+	Severity string
+	Subject  string
+	Text     string
+	HTML     string
+}
+
+// renderNotification renders the messages for a notification type.
+func renderNotification(data notificationData) (renderedNotification, error) {
+	kind := getNotificationKind(data.Type)
+	var subject, text, html bytes.Buffer
+	if err := kind.subject.Execute(&subject, data); err != nil {
+		return renderedNotification{}, fmt.Errorf("render %s subject: %w", data.Type, err)
+	}
+	if err := kind.text.Execute(&text, data); err != nil {
+		return renderedNotification{}, fmt.Errorf("render %s text: %w", data.Type, err)
+	}
+	if err := kind.html.Execute(&html, data); err != nil {
+		return renderedNotification{}, fmt.Errorf("render %s html: %w", data.Type, err)
+	}
+	return renderedNotification{
+		Severity: kind.Severity,
+		// A subject is a single header line
+		Subject: strings.Join(strings.Fields(subject.String()), " "),
+		Text:    text.String(),
+		HTML:    html.String(),
+	}, nil
+}
+
+// latestReadings returns the most recent reading of each sensor type a plant
+// has logged in the last maxLogAge, sorted by type.
+func latestReadings(plantID string) ([]latestReading, error) {
+	rows, err := db.Query(
+		`SELECT l.log_type, l.log_value, l.log_time FROM plant_logs l
+		 JOIN (SELECT log_type, MAX(log_time) AS t FROM plant_logs WHERE plant_id = ? AND log_time > ? GROUP BY log_type) m
+		   ON l.log_type = m.log_type AND l.log_time = m.t
+		 WHERE l.plant_id = ?`,
+		plantID, time.Now().UTC().Add(-maxLogAge), plantID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("select latest readings: %w", err)
+	}
+	defer rows.Close()
+
+	seen := map[string]bool{}
+	var readings []latestReading
+	for rows.Next() {
+		var r latestReading
+		var timeStr string
+		if err := rows.Scan(&r.LogType, &r.Value, &timeStr); err != nil {
+			return nil, fmt.Errorf("scan latest reading: %w", err)
+		}
+		st, ok := sensorTypes.get(r.LogType)
+		if !ok || seen[r.LogType] {
+			continue
+		}
+		seen[r.LogType] = true
+		if r.Time, err = parseDBTime(timeStr); err != nil {
+			return nil, err
+		}
+		r.DisplayName, r.Unit, r.Value = st.DisplayName, st.Unit, st.round(r.Value)
+		readings = append(readings, r)
+	}
+	sort.Slice(readings, func(i, j int) bool { return readings[i].LogType < readings[j].LogType })
+	return readings, rows.Err()
+}
+
+// plantNotificationData gathers what the templates need about a plant. A
+// failure to load the readings is logged and the message sent without them.
+func plantNotificationData(notificationType string, owner plantOwner, plantID string, extra map[string]interface{}) notificationData {
+	readings, err := latestReadings(plantID)
+	if err != nil {
+		log.Printf("Error loading latest readings of %s: %v", plantID, err)
+	}
+	return notificationData{
+		Type:      notificationType,
+		PlantID:   plantID,
+		PlantName: owner.PlantName,
+		PlantType: owner.PlantType,
+		Username:  owner.Username,
+		Readings:  readings,
+		Extra:     extra,
+	}
+}
+
+// handleGetNotificationTypes lists the known notification types.
+func handleGetNotificationTypes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if _, ok := getSessionUserID(r); !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	kinds := make([]notificationKind, 0, len(notificationKinds))
+	for _, k := range notificationKinds {
+		kinds = append(kinds, k)
+	}
+	sort.Slice(kinds, func(i, j int) bool { return kinds[i].Name < kinds[j].Name })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(kinds)
+}
@@ -0,0 +1,418 @@
+// `outbox.go` contains the notification outbox: notifications are stored
+// first and delivered by a background worker that retries failures
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Statuses of a notification in the outbox.
+const (
+	outboxPending    = "pending"
+	outboxSent       = "sent"
+	outboxFailed     = "failed"
+	outboxSuppressed = "suppressed"
+)
+
+// Reasons a notification is suppressed: by the user's preferences, or because
+// it would be emailed to an address that hasn't been verified.
+const (
+	suppressedMuted      = "muted"
+	suppressedDuplicate  = "duplicate"
+	suppressedUnverified = "unverified_email"
+)
+
+// A failed delivery is retried after outboxRetryBase, doubling after each
+// further failure up to outboxRetryMax, until outboxMaxAttempts have been
+// made. The notification is then marked failed.
+const (
+	outboxRetryBase   = 30 * time.Second
+	outboxRetryMax    = time.Hour
+	outboxMaxAttempts = 8
+)
+
+// The worker looks for due notifications every outboxPollInterval, and right
+// away when one is queued. It claims at most outboxBatchSize at a time, and a
+// claimed notification whose delivery never finished (e.g. the server was
+// restarted mid-send) is retried after outboxClaimTimeout.
+const (
+	outboxPollInterval = 10 * time.Second
+	outboxBatchSize    = 20
+	outboxClaimTimeout = 5 * time.Minute
+)
+
+// outboxNotification is a single row of the notification_outbox table.
+type outboxNotification struct {
+	NotificationID int64      `json:"notificationId"`
+	UserID         int        `json:"userId"`
+	PlantID        string     `json:"plantId,omitempty"`
+	Type           string     `json:"type"`
+	Recipient      string     `json:"recipient"`
+	Channel        string     `json:"channel,omitempty"`
+	Severity       string     `json:"severity"`
+	Subject        string     `json:"subject"`
+	Body           string     `json:"-"`
+	HTMLBody       string     `json:"-"`
+	Status         string     `json:"status"`
+	Suppressed     string     `json:"suppressedReason,omitempty"`
+	Attempts       int        `json:"attempts"`
+	LastError      string     `json:"lastError,omitempty"`
+	CreatedAt      time.Time  `json:"createdAt"`
+	NextAttemptAt  *time.Time `json:"nextAttemptAt,omitempty"`
+	SentAt         *time.Time `json:"sentAt,omitempty"`
+}
+
+// outboxWake is signalled when a notification is queued so the worker
+// doesn't wait for its next poll.
+var outboxWake = make(chan struct{}, 1)
+
+// queueNotification stores a notification for the worker to deliver and
+// returns its ID. It is delivered right away, or not before n.NextAttemptAt
+// if that is set. If n.Suppressed is set it is stored as suppressed instead,
+// and never delivered.
+func queueNotification(n outboxNotification) (int64, error) {
+	now := time.Now().UTC().Truncate(time.Second)
+	status, nextAttempt := outboxPending, &now
+	if n.NextAttemptAt != nil {
+		nextAttempt = n.NextAttemptAt
+	}
+	if n.Suppressed != "" {
+		status, nextAttempt = outboxSuppressed, nil
+	}
+	res, err := db.Exec(
+		`INSERT INTO notification_outbox (user_id, plant_id, notification_type, severity, recipient, subject, body, body_html,
+		   status, suppressed_reason, attempts, next_attempt_at, created_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, 0, ?, ?)`,
+		n.UserID, nullableString(n.PlantID), n.Type, n.Severity, n.Recipient, n.Subject, n.Body, nullableString(n.HTMLBody),
+		status, nullableString(n.Suppressed), nextAttempt, now,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("insert notification: %w", err)
+	}
+	id, _ := res.LastInsertId()
+	if status == outboxSuppressed {
+		return id, nil
+	}
+
+	select {
+	case outboxWake <- struct{}{}:
+	default:
+	}
+	return id, nil
+}
+
+// notifyPlantOwner renders a notification about a plant from its type's
+// templates (see notifytypes.go), queues it to the plant's owner and tells any
+// open dashboards about it. extra is passed to the templates as .Extra. It
+// returns sql.ErrNoRows if the plant has no owner.
+func notifyPlantOwner(plantID, notificationType string, extra map[string]interface{}) (int64, error) {
+	owner, err := getPlantOwner(plantID)
+	if err != nil {
+		return 0, err
+	}
+	msg, err := renderNotification(plantNotificationData(notificationType, owner, plantID, extra))
+	if err != nil {
+		return 0, err
+	}
+	suppressed, holdUntil, err := suppressionReason(owner, plantID, notificationType, msg.Severity, time.Now().UTC())
+	if err != nil {
+		// Better to notify too often than to lose a notification
+		log.Printf("Error checking notification preferences: %v", err)
+	}
+	id, err := queueNotification(outboxNotification{
+		UserID:        owner.UserID,
+		PlantID:       plantID,
+		Type:          notificationType,
+		Severity:      msg.Severity,
+		Recipient:     owner.Email,
+		Subject:       msg.Subject,
+		Body:          msg.Text,
+		HTMLBody:      msg.HTML,
+		Suppressed:    suppressed,
+		NextAttemptAt: holdUntil,
+	})
+	if err != nil {
+		return 0, err
+	}
+	events.publish(plantID, eventNotification, notificationEvent{NotificationType: notificationType})
+	return id, nil
+}
+
+// suppressionReason applies a user's preferences to a notification about to be
+// queued. It returns why the notification shouldn't be sent, or "" if it
+// should. A notification that falls in the user's quiet hours is held rather
+// than suppressed: the returned time is when they end, and it shouldn't be
+// sent before then. Critical notifications are sent during quiet hours, but
+// are still subject to muting and the dedupe window. Nothing is emailed to an
+// owner whose address hasn't been verified.
+func suppressionReason(owner plantOwner, plantID, notificationType, severity string, now time.Time) (string, *time.Time, error) {
+	userID := owner.UserID
+	prefs, err := loadNotificationPreferences(userID)
+	if err != nil {
+		return "", nil, err
+	}
+	if prefs.Channel == channelEmail && !owner.EmailVerified {
+		return suppressedUnverified, nil, nil
+	}
+	if prefs.muted(notificationType) {
+		return suppressedMuted, nil, nil
+	}
+	if window := prefs.dedupeWindow(); window > 0 {
+		var recent int
+		err := db.QueryRow(
+			`SELECT COUNT(*) FROM notification_outbox
+			 WHERE user_id = ? AND plant_id = ? AND notification_type = ? AND status <> ? AND created_at > ?`,
+			userID, plantID, notificationType, outboxSuppressed, now.Add(-window),
+		).Scan(&recent)
+		if err != nil {
+			return "", nil, fmt.Errorf("count recent notifications: %w", err)
+		}
+		if recent > 0 {
+			return suppressedDuplicate, nil, nil
+		}
+	}
+	if severity != severityCritical {
+		if until, ok := prefs.quietHoursEnd(now); ok {
+			return "", &until, nil
+		}
+	}
+	return "", nil, nil
+}
+
+// runOutboxWorker delivers queued notifications forever. It is started from
+// main.
+func runOutboxWorker() {
+	ticker := time.NewTicker(outboxPollInterval)
+	defer ticker.Stop()
+	for {
+		for {
+			n, err := deliverDueNotifications(time.Now().UTC())
+			if err != nil {
+				log.Printf("outbox: %v", err)
+			}
+			// keep going while there may be more due than fit in a batch
+			if err != nil || n < outboxBatchSize {
+				break
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-outboxWake:
+		}
+	}
+}
+
+// deliverDueNotifications claims the notifications that are due and tries to
+// deliver each one. It returns how many it claimed.
+func deliverDueNotifications(now time.Time) (int, error) {
+	due, err := claimDueNotifications(now)
+	if err != nil {
+		return 0, err
+	}
+	for _, n := range due {
+		err := deliverNotification(&n)
+		if err := recordDeliveryAttempt(n, err, time.Now().UTC()); err != nil {
+			log.Printf("outbox: recording attempt on notification %d: %v", n.NotificationID, err)
+		}
+	}
+	return len(due), nil
+}
+
+// deliverNotification sends n through the channel its user has chosen, and
+// sets n.Channel to it.
+func deliverNotification(n *outboxNotification) error {
+	nt, err := userNotifier(n.UserID, n.Recipient)
+	if err != nil {
+		return err
+	}
+	n.Channel = nt.channel()
+	return nt.notify(notification{
+		NotificationID: n.NotificationID,
+		Type:           n.Type,
+		Severity:       n.Severity,
+		PlantID:        n.PlantID,
+		Subject:        n.Subject,
+		Body:           n.Body,
+		HTML:           n.HTMLBody,
+		CreatedAt:      n.CreatedAt,
+	})
+}
+
+// claimDueNotifications selects pending notifications whose next attempt is
+// due and pushes that attempt back by outboxClaimTimeout, so they aren't
+// picked up again while being delivered.
+func claimDueNotifications(now time.Time) ([]outboxNotification, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(
+		`SELECT notification_id, user_id, plant_id, notification_type, severity, recipient, subject, body, body_html, attempts, created_at
+		 FROM notification_outbox
+		 WHERE status = ? AND next_attempt_at <= ?
+		 ORDER BY next_attempt_at LIMIT ? FOR UPDATE`,
+		outboxPending, now, outboxBatchSize,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("select due notifications: %w", err)
+	}
+	var due []outboxNotification
+	for rows.Next() {
+		var n outboxNotification
+		var plantID, htmlBody sql.NullString
+		var createdStr string
+		if err := rows.Scan(&n.NotificationID, &n.UserID, &plantID, &n.Type, &n.Severity, &n.Recipient, &n.Subject, &n.Body, &htmlBody, &n.Attempts, &createdStr); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("scan notification: %w", err)
+		}
+		n.PlantID, n.HTMLBody = plantID.String, htmlBody.String
+		if n.CreatedAt, err = parseDBTime(createdStr); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		due = append(due, n)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate notifications: %w", err)
+	}
+
+	for _, n := range due {
+		_, err := tx.Exec("UPDATE notification_outbox SET next_attempt_at = ? WHERE notification_id = ?", now.Add(outboxClaimTimeout), n.NotificationID)
+		if err != nil {
+			return nil, fmt.Errorf("claim notification %d: %w", n.NotificationID, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("commit: %w", err)
+	}
+	return due, nil
+}
+
+// recordDeliveryAttempt stores the outcome of trying to deliver n, scheduling
+// a retry or giving up if it failed.
+func recordDeliveryAttempt(n outboxNotification, sendErr error, now time.Time) error {
+	attempts := n.Attempts + 1
+	if sendErr == nil {
+		_, err := db.Exec(
+			"UPDATE notification_outbox SET status = ?, channel = ?, attempts = ?, sent_at = ?, next_attempt_at = NULL WHERE notification_id = ?",
+			outboxSent, nullableString(n.Channel), attempts, now, n.NotificationID,
+		)
+		return err
+	}
+
+	lastError := truncate(sendErr.Error(), 500)
+	if attempts >= outboxMaxAttempts {
+		log.Printf("outbox: giving up on notification %d after %d attempts: %v", n.NotificationID, attempts, sendErr)
+		_, err := db.Exec(
+			"UPDATE notification_outbox SET status = ?, channel = ?, attempts = ?, last_error = ?, next_attempt_at = NULL WHERE notification_id = ?",
+			outboxFailed, nullableString(n.Channel), attempts, lastError, n.NotificationID,
+		)
+		return err
+	}
+	_, err := db.Exec(
+		"UPDATE notification_outbox SET channel = ?, attempts = ?, last_error = ?, next_attempt_at = ? WHERE notification_id = ?",
+		nullableString(n.Channel), attempts, lastError, now.Add(outboxRetryDelay(attempts)), n.NotificationID,
+	)
+	return err
+}
+
+// outboxRetryDelay is how long to wait before the next attempt after the
+// given number of failed ones.
+func outboxRetryDelay(attempts int) time.Duration {
+	d := outboxRetryBase
+	for i := 1; i < attempts && d < outboxRetryMax; i++ {
+		d *= 2
+	}
+	if d > outboxRetryMax {
+		d = outboxRetryMax
+	}
+	return d
+}
+
+// handleGetFailedNotifications lets the logged in user see their
+// notifications that could not be delivered, newest first, e.g. to spot a
+// mistyped webhook URL. With
+// ?includeRetrying=true it also lists pending notifications that have failed
+// at least once and are waiting to be retried. Optional query parameter
+// limit (default 100, at most 500).
+func handleGetFailedNotifications(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, ok := getSessionUserID(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	limit := 100
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+		if limit > 500 {
+			limit = 500
+		}
+	}
+
+	query := `SELECT notification_id, user_id, plant_id, notification_type, severity, recipient, channel, subject, status, attempts,
+	                 last_error, created_at, next_attempt_at, sent_at
+	          FROM notification_outbox WHERE user_id = ? AND (status = ?`
+	args := []interface{}{userID, outboxFailed}
+	if r.URL.Query().Get("includeRetrying") == "true" {
+		query += " OR (status = ? AND attempts > 0)"
+		args = append(args, outboxPending)
+	}
+	query += ") ORDER BY notification_id DESC LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		log.Printf("Error querying failed notifications: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	notifications := make([]outboxNotification, 0)
+	for rows.Next() {
+		var n outboxNotification
+		var plantID, channel, lastError, nextStr, sentStr sql.NullString
+		var createdStr string
+		if err := rows.Scan(&n.NotificationID, &n.UserID, &plantID, &n.Type, &n.Severity, &n.Recipient, &channel, &n.Subject, &n.Status, &n.Attempts,
+			&lastError, &createdStr, &nextStr, &sentStr); err != nil {
+			log.Printf("Error scanning notification row: %v", err)
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+		n.PlantID, n.Channel, n.LastError = plantID.String, channel.String, lastError.String
+		if n.CreatedAt, err = parseDBTime(createdStr); err == nil {
+			if n.NextAttemptAt, err = parseNullDBTime(nextStr); err == nil {
+				n.SentAt, err = parseNullDBTime(sentStr)
+			}
+		}
+		if err != nil {
+			log.Printf("Error parsing notification times: %v", err)
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+		notifications = append(notifications, n)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(notifications)
+}
@@ -0,0 +1,216 @@
+// `passwordreset.go` contains the "forgot password" flow: a single-use token
+// is emailed to the user, and exchanging it sets a new password.
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// publicURL is where users reach the frontend, for links in emails. It is set
+// from the environment in main.
+var publicURL = "https://potbot.online"
+
+// passwordResetLifetime is how long an emailed reset link works. It is set
+// from the environment in main.
+var passwordResetLifetime = time.Hour
+
+// passwordResetResendInterval is how often a reset email can be sent to the
+// same account, so the endpoint can't be used to flood someone's inbox.
+const passwordResetResendInterval = time.Minute
+
+// handleRequestPasswordReset emails a password reset link to the account with
+// an email address. It responds the same whether or not there is one, so it
+// can't be used to find out who has an account; the work is done in the
+// background for the same reason.
+// Expects POST JSON body: { "email": "<email>" }
+func handleRequestPasswordReset(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	email := strings.TrimSpace(req.Email)
+	if email == "" {
+		http.Error(w, "email required", http.StatusBadRequest)
+		return
+	}
+
+	go func() {
+		if err := sendPasswordReset(email, time.Now().UTC()); err != nil {
+			log.Printf("Error sending password reset: %v", err)
+		}
+	}()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{
+		"status": "If an account with that email exists, a reset link has been sent to it.",
+	})
+}
+
+// sendPasswordReset creates a reset token for the account with an email
+// address, if there is one, and emails it. Earlier unused tokens of the
+// account stop working.
+func sendPasswordReset(email string, now time.Time) error {
+	var userID int
+	var username sql.NullString
+	err := db.QueryRow("SELECT user_id, username FROM users WHERE email = ?", email).Scan(&userID, &username)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("look up user: %w", err)
+	}
+
+	var recent int
+	err = db.QueryRow(
+		"SELECT COUNT(*) FROM password_reset_tokens WHERE user_id = ? AND created_at > ?",
+		userID, now.Add(-passwordResetResendInterval),
+	).Scan(&recent)
+	if err != nil {
+		return fmt.Errorf("count recent reset tokens: %w", err)
+	}
+	if recent > 0 {
+		return nil
+	}
+
+	token, err := newToken()
+	if err != nil {
+		return err
+	}
+	if _, err := db.Exec("DELETE FROM password_reset_tokens WHERE user_id = ?", userID); err != nil {
+		return fmt.Errorf("delete old reset tokens: %w", err)
+	}
+	now = now.Truncate(time.Second)
+	_, err = db.Exec(
+		"INSERT INTO password_reset_tokens (token_hash, user_id, created_at, expires_at) VALUES (?, ?, ?, ?)",
+		hashToken(token), userID, now, now.Add(passwordResetLifetime),
+	)
+	if err != nil {
+		return fmt.Errorf("insert reset token: %w", err)
+	}
+
+	link := strings.TrimRight(publicURL, "/") + "/?reset_token=" + url.QueryEscape(token)
+	body := fmt.Sprintf(
+		"Hi %s,\n\nSomeone asked to reset the password of your Potbot account. To choose a new password, open this link within %s:\n\n%s\n\nIf it wasn't you, you can ignore this email; your password hasn't been changed.\n",
+		displayName(username.String), passwordResetLifetime, link,
+	)
+	return sendEmail(email, "Reset your Potbot password", body)
+}
+
+// displayName is how emails greet a user.
+func displayName(username string) string {
+	if username == "" {
+		return "there"
+	}
+	return username
+}
+
+// handleConfirmPasswordReset sets a new password using an emailed reset
+// token. The token can only be used once, every session of the account is
+// logged out, and any login lockout is lifted.
+// Expects POST JSON body: { "token": "<token>", "password": "<new password>" }
+func handleConfirmPasswordReset(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Token == "" || req.Password == "" {
+		http.Error(w, "token and password required", http.StatusBadRequest)
+		return
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC().Truncate(time.Second)
+	var userID int
+	err = tx.QueryRow(
+		"SELECT user_id FROM password_reset_tokens WHERE token_hash = ? AND used_at IS NULL AND expires_at > ? FOR UPDATE",
+		hashToken(req.Token), now,
+	).Scan(&userID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "invalid or expired token", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("Error looking up reset token: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := tx.Exec("UPDATE password_reset_tokens SET used_at = ? WHERE token_hash = ?", now, hashToken(req.Token)); err != nil {
+		log.Printf("Error using reset token: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	// login_failures before users, the order reserveAccountAttempt locks them in
+	if _, err := tx.Exec("DELETE FROM login_failures WHERE user_id = ?", userID); err != nil {
+		log.Printf("Error lifting login lockout: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	_, err = tx.Exec(
+		"UPDATE users SET password_hash = ?, login_failures = 0, last_login_failure_at = NULL, next_login_attempt_at = NULL WHERE user_id = ?",
+		string(hash), userID,
+	)
+	if err != nil {
+		log.Printf("Error updating password: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if _, err := tx.Exec("DELETE FROM sessions WHERE user_id = ?", userID); err != nil {
+		log.Printf("Error revoking sessions: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if _, err := tx.Exec("DELETE FROM login_challenges WHERE user_id = ?", userID); err != nil {
+		log.Printf("Error revoking login tokens: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing password reset: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	clearSessionCookie(w)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -4,16 +4,19 @@ package main
 import (
 	"database/sql"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"log"
+	"math"
 	"net/http"
-	"slices"
+	"strconv"
 	"time"
 
 	"golang.org/x/crypto/bcrypt"
 )
 
-var validLogTypes = []string{"light", "temp", "moisture"}
+// maxFetchWait caps how long handleFetchCommands holds a long-poll open. It is
+// kept below Apache's default 60s proxy timeout.
+const maxFetchWait = 50 * time.Second
 
 func handleVerifyPlantCreds(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "GET" {
@@ -65,19 +68,26 @@ func verifyPlantCreds(w http.ResponseWriter, r *http.Request) (bool, string) {
 		return false, ""
 	}
 
+	markPlantSeen(plantID)
 	return true, plantID
 }
 
 // Request body for logging a plant value
 type plantLogRequest struct {
-	LogType  string  `json:"logType"`
-	LogValue float64 `json:"logValue"`
+	LogType   string           `json:"logType"`
+	LogValue  float64          `json:"logValue"`
+	Timestamp *deviceTimestamp `json:"timestamp"`
+	SentAt    *deviceTimestamp `json:"sentAt"`
 }
 
 // handlePlantLog allows a plant (authenticated via cookies) to log a value of a specific type.
 // Expects JSON body: { "logType": "<type>", "logValue": <number> }
-// Uses current server time for log_time.
-// logType must be one of validLogTypes
+// logType must be one of the registered sensor types and logValue a finite
+// number. Values outside the sensor's range are accepted but logged.
+// The optional "timestamp" (RFC 3339 or unix seconds) is when the reading was
+// taken and defaults to the current server time. The optional "sentAt" is the
+// device's clock when it sent the request, used to correct the timestamp for
+// a device clock that is off. See resolveLogTime for the rules applied.
 func handlePlantLog(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
@@ -94,17 +104,17 @@ func handlePlantLog(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if !slices.Contains(validLogTypes, req.LogType) {
-		http.Error(w, "invalid log type", http.StatusBadRequest)
+	logTime, err := resolveLogTime(req.Timestamp, req.SentAt, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// Insert into plant_logs using current server time
-	_, err := db.Exec(
-		"INSERT INTO plant_logs (plant_id, log_type, log_time, log_value) VALUES (?, ?, ?, ?)",
-		plantID, req.LogType, time.Now(), req.LogValue,
-	)
-	if err != nil {
+	err = insertPlantLog(plantID, req.LogType, req.LogValue, logTime)
+	if isLogValidationError(err) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
 		log.Printf("error inserting plant log: %v", err)
 		http.Error(w, "server error", http.StatusInternalServerError)
 		return
@@ -114,9 +124,73 @@ func handlePlantLog(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
 }
 
+var errInvalidLogType = errors.New("invalid log type")
+var errInvalidLogValue = errors.New("log value must be a finite number")
+
+// validatePlantLog checks a reading against the sensor type registry before it
+// is stored. It returns errInvalidLogType if logType isn't a registered sensor
+// type, or errInvalidLogValue if logValue is NaN or infinite.
+//
+// A value outside the sensor's range is only logged, not rejected: plants
+// were logging such values before the ranges existed, and deployed firmware
+// would lose the readings.
+func validatePlantLog(plantID, logType string, logValue float64) error {
+	st, ok := sensorTypes.get(logType)
+	if !ok {
+		return errInvalidLogType
+	}
+	if math.IsNaN(logValue) || math.IsInf(logValue, 0) {
+		return errInvalidLogValue
+	}
+	if (st.Min != nil && logValue < *st.Min) || (st.Max != nil && logValue > *st.Max) {
+		log.Printf("Plant %s logged %s %v, outside the expected range %s to %s", plantID, logType, logValue, formatBound(st.Min), formatBound(st.Max))
+	}
+	return nil
+}
+
+func formatBound(b *float64) string {
+	if b == nil {
+		return "unbounded"
+	}
+	return strconv.FormatFloat(*b, 'f', -1, 64)
+}
+
+// isLogValidationError reports whether err came from validatePlantLog, as
+// opposed to a database error.
+func isLogValidationError(err error) bool {
+	return errors.Is(err, errInvalidLogType) || errors.Is(err, errInvalidLogValue)
+}
+
+// insertPlantLog validates and stores a single reading from a plant.
+func insertPlantLog(plantID, logType string, logValue float64, logTime time.Time) error {
+	if err := validatePlantLog(plantID, logType, logValue); err != nil {
+		return err
+	}
+	_, err := db.Exec(
+		"INSERT INTO plant_logs (plant_id, log_type, log_time, log_value) VALUES (?, ?, ?, ?)",
+		plantID, logType, logTime, logValue,
+	)
+	if err != nil {
+		return err
+	}
+	events.publish(plantID, eventLog, logEvent{LogType: logType, Entry: PlantLogEntry{Val: logValue, Time: logTime.UTC().Truncate(time.Second)}})
+	evaluateAlerts(plantID, logType, logValue, logTime)
+	return nil
+}
+
 // handleFetchCommands allows an authenticated plant (via cookies) to fetch
-// all pending commands queued for it. It returns a JSON array of strings
-// and clears the pending commands for that plant.
+// all pending commands queued for it, marking them as delivered.
+// By default it returns a JSON array of upper-cased command names (e.g.
+// "WATER"), which is what the existing firmware understands. With
+// ?format=full it returns an array of PlantCommand objects including each
+// command's ID, created time and structured arguments; plants
+// using this format are expected to acknowledge each command through
+// /api/ack_command, and commands that aren't acknowledged in time are
+// delivered again on a later fetch.
+//
+// With ?wait=<seconds> (at most maxFetchWait) the request is held open until
+// a command is queued for the plant or the wait elapses, so plants can get
+// commands promptly without polling on a short interval.
 func handleFetchCommands(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "GET" {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
@@ -128,17 +202,112 @@ func handleFetchCommands(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var cmds []string = make([]string, 0)
-	if pendingCommands != nil {
-		if c, exists := pendingCommands[plantID]; exists {
-			cmds = c
+	full := r.URL.Query().Get("format") == "full"
+
+	var wait time.Duration
+	if waitStr := r.URL.Query().Get("wait"); waitStr != "" {
+		secs, err := strconv.Atoi(waitStr)
+		if err != nil || secs < 0 {
+			http.Error(w, "wait must be a non-negative number of seconds", http.StatusBadRequest)
+			return
+		}
+		wait = time.Duration(secs) * time.Second
+		if wait > maxFetchWait {
+			wait = maxFetchWait
 		}
-		// clear commands for this plant
-		delete(pendingCommands, plantID)
+	}
+
+	// Subscribe before checking the queue so a command issued in between
+	// isn't missed.
+	woken, unsubscribe := commandWaiters.subscribe(plantID)
+	defer unsubscribe()
+
+	cmds, err := takeQueuedCommands(plantID, full)
+	if err == nil && len(cmds) == 0 && wait > 0 {
+		timer := time.NewTimer(wait)
+		select {
+		case <-woken:
+			cmds, err = takeQueuedCommands(plantID, full)
+		case <-timer.C:
+		case <-r.Context().Done():
+		}
+		timer.Stop()
+	}
+	if err != nil {
+		log.Printf("Error fetching queued commands: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(cmds)
+	if full {
+		json.NewEncoder(w).Encode(cmds)
+		return
+	}
+	strs := make([]string, 0, len(cmds))
+	for _, c := range cmds {
+		strs = append(strs, c.Command.legacyString())
+	}
+	json.NewEncoder(w).Encode(strs)
+}
+
+// Request body for acknowledging a command
+type ackCommandRequest struct {
+	CommandID int64  `json:"commandId"`
+	Success   bool   `json:"success"`
+	Message   string `json:"message"`
+}
+
+// handleAckCommand is called by a plant (authenticated via cookies) once it has
+// carried out a command fetched with ?format=full. It expects JSON body:
+// { "commandId": <id>, "success": <bool>, "message": "<optional string>" }
+func handleAckCommand(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ok, plantID := verifyPlantCreds(w, r)
+	if !ok {
+		return
+	}
+
+	var req ackCommandRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.CommandID == 0 {
+		http.Error(w, "commandId is required", http.StatusBadRequest)
+		return
+	}
+	if len(req.Message) > 500 {
+		http.Error(w, "message is too long", http.StatusBadRequest)
+		return
+	}
+
+	err := acknowledgeCommand(plantID, req.CommandID, req.Success, req.Message)
+	if err == errCommandNotFound {
+		http.Error(w, "command not found", http.StatusNotFound)
+		return
+	} else if err == errCommandAlreadyAcked {
+		http.Error(w, "command already acknowledged", http.StatusConflict)
+		return
+	} else if err == errCommandExpired {
+		http.Error(w, "command expired", http.StatusConflict)
+		return
+	} else if err == errCommandNotDelivered {
+		http.Error(w, "command not delivered yet", http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Printf("Error acknowledging command: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"status": "acknowledged"})
 }
 
 // Request body for plant notifications
@@ -148,6 +317,8 @@ type plantNotifyRequest struct {
 
 // handlePlantNotify is called by a plant (authenticated via cookies) to notify
 // the owner about an event. It expects JSON body: { "notificationType": "xxxxx" }
+// The notification is delivered in the background (see outbox.go), so this
+// responds 202 as soon as it has been queued.
 func handlePlantNotify(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
@@ -169,34 +340,28 @@ func handlePlantNotify(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "notification_type is required", http.StatusBadRequest)
 		return
 	}
-
-	// Lookup owner's email for the plant
-	var ownerEmail sql.NullString
-	err := db.QueryRow("SELECT u.email FROM users u JOIN plants p ON p.user_id = u.user_id WHERE p.plant_id = ?", plantID).Scan(&ownerEmail)
-	if err == sql.ErrNoRows || !ownerEmail.Valid {
-		http.Error(w, "plant has no associated user", http.StatusBadRequest)
-		return
-	} else if err != nil {
-		log.Printf("Error querying owner email: %v", err)
-		http.Error(w, "server error", http.StatusInternalServerError)
+	if !notificationTypeRe.MatchString(req.NotificationType) {
+		http.Error(w, "notificationType must be upper case letters, digits and underscores", http.StatusBadRequest)
 		return
 	}
-
-	// Build subject and body based on notification type
-	subject := fmt.Sprintf("Potbot notification for %s", plantID)
-	body := fmt.Sprintf("Your plant (ID: %s) sent notification: %s", plantID, req.NotificationType)
-	switch req.NotificationType {
-	case "FALLEN":
-		subject = "Your plant has fallen over"
-		body = fmt.Sprintf("Hi — your plant (ID: %s) appears to have fallen over. Please check on it.", plantID)
+	if getNotificationKind(req.NotificationType).Internal {
+		http.Error(w, "notificationType "+req.NotificationType+" can only be sent by the server", http.StatusBadRequest)
+		return
 	}
 
-	if err := sendEmail(ownerEmail.String, subject, body); err != nil {
-		log.Printf("error sending notification email: %v", err)
+	// Queue it for the outbox worker, so a mail server hiccup doesn't fail
+	// the device's request or lose the notification. The message comes from
+	// the type's templates in notifytypes.go.
+	id, err := notifyPlantOwner(plantID, req.NotificationType, nil)
+	if err == sql.ErrNoRows {
+		http.Error(w, "plant has no associated user", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		log.Printf("Error queueing notification: %v", err)
 		http.Error(w, "server error", http.StatusInternalServerError)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{"status": "notified"})
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "queued", "notificationId": id})
 }
@@ -0,0 +1,125 @@
+// `presence.go` contains the tracking of when each plant was last heard from,
+// and the background job that tells owners when a plant goes quiet
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// A plant is considered offline once it hasn't been heard from for
+// plantOfflineAfter, unless it has a WebSocket open. The checker looks for
+// newly offline plants every offlineCheckInterval. Both are set from the
+// environment in main.
+var (
+	plantOfflineAfter    = 15 * time.Minute
+	offlineCheckInterval = time.Minute
+)
+
+// lastSeenWriteInterval limits how often a plant's last_seen_at is written,
+// since a chatty plant may make many requests a minute.
+const lastSeenWriteInterval = 30 * time.Second
+
+// seenTracker remembers when each plant's last_seen_at was last written. It is
+// safe for concurrent use.
+type seenTracker struct {
+	mu      sync.Mutex
+	written map[string]time.Time
+}
+
+var plantsSeen = &seenTracker{written: make(map[string]time.Time)}
+
+// markPlantSeen records that a plant has just made an authenticated request.
+func markPlantSeen(plantID string) {
+	now := time.Now().UTC()
+	plantsSeen.mu.Lock()
+	if now.Sub(plantsSeen.written[plantID]) < lastSeenWriteInterval {
+		plantsSeen.mu.Unlock()
+		return
+	}
+	plantsSeen.written[plantID] = now
+	plantsSeen.mu.Unlock()
+
+	if _, err := db.Exec("UPDATE plants SET last_seen_at = ? WHERE plant_id = ?", now.Truncate(time.Second), plantID); err != nil {
+		log.Printf("Error updating last seen time of %s: %v", plantID, err)
+	}
+}
+
+// plantOnline reports whether a plant last seen at lastSeen counts as online.
+func plantOnline(plantID string, lastSeen *time.Time) bool {
+	if devices.online(plantID) {
+		return true
+	}
+	return lastSeen != nil && time.Since(*lastSeen) < plantOfflineAfter
+}
+
+// runOfflineChecker emails owners about plants that have gone offline,
+// forever. It is started from main.
+func runOfflineChecker() {
+	for {
+		if err := notifyOfflinePlants(time.Now().UTC()); err != nil {
+			log.Printf("offline checker: %v", err)
+		}
+		time.Sleep(offlineCheckInterval)
+	}
+}
+
+// notifyOfflinePlants emails the owner of each plant that has been silent for
+// longer than plantOfflineAfter. A plant is reported once per outage: the
+// notification isn't repeated until it has been seen again since.
+func notifyOfflinePlants(now time.Time) error {
+	rows, err := db.Query(
+		`SELECT p.plant_id, p.plant_name, p.last_seen_at
+		 FROM plants p
+		 WHERE p.user_id IS NOT NULL AND p.last_seen_at < ? AND (p.offline_notified_at IS NULL OR p.offline_notified_at < p.last_seen_at)`,
+		now.Add(-plantOfflineAfter),
+	)
+	if err != nil {
+		return fmt.Errorf("select offline plants: %w", err)
+	}
+
+	type offlinePlant struct {
+		plantID, plantName string
+		lastSeen           time.Time
+	}
+	var offline []offlinePlant
+	for rows.Next() {
+		var p offlinePlant
+		var name sql.NullString
+		var lastSeenStr string
+		if err := rows.Scan(&p.plantID, &name, &lastSeenStr); err != nil {
+			rows.Close()
+			return fmt.Errorf("scan offline plant: %w", err)
+		}
+		if p.lastSeen, err = parseDBTime(lastSeenStr); err != nil {
+			rows.Close()
+			return err
+		}
+		p.plantName = name.String
+		if p.plantName == "" {
+			p.plantName = p.plantID
+		}
+		offline = append(offline, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("iterate offline plants: %w", err)
+	}
+
+	for _, p := range offline {
+		// A plant on a WebSocket may have nothing to say for a while
+		if devices.online(p.plantID) {
+			continue
+		}
+		if _, err := db.Exec("UPDATE plants SET offline_notified_at = ? WHERE plant_id = ?", now.Truncate(time.Second), p.plantID); err != nil {
+			return fmt.Errorf("mark %s notified: %w", p.plantID, err)
+		}
+		if _, err := notifyPlantOwner(p.plantID, "OFFLINE", map[string]interface{}{"LastSeen": p.lastSeen}); err != nil {
+			log.Printf("offline checker: error queueing notification for %s: %v", p.plantID, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,304 @@
+// `retention.go` contains the background job that rolls old plant readings up
+// into hourly and daily summary tables, and the reads across those tiers
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Raw readings older than rawLogRetention are rolled up into
+// plant_logs_hourly and deleted, and hourly summaries older than
+// hourlyLogRetention are rolled up into plant_logs_daily and deleted. Daily
+// summaries are kept forever. All three are set from the environment in main.
+var (
+	rawLogRetention    = 30 * 24 * time.Hour
+	hourlyLogRetention = 365 * 24 * time.Hour
+	retentionInterval  = time.Hour
+)
+
+// runRetention compacts plant_logs and drops expired sessions, login tokens
+// and stale failed logins forever. It is started from main.
+func runRetention() {
+	for {
+		if err := compactPlantLogs(time.Now()); err != nil {
+			log.Printf("retention: %v", err)
+		}
+		if err := deleteExpiredSessions(time.Now()); err != nil {
+			log.Printf("retention: %v", err)
+		}
+		if err := deleteStaleLoginFailures(time.Now()); err != nil {
+			log.Printf("retention: %v", err)
+		}
+		if err := deleteExpiredLoginChallenges(time.Now()); err != nil {
+			log.Printf("retention: %v", err)
+		}
+		time.Sleep(retentionInterval)
+	}
+}
+
+// Compaction works through one plant at a time, and through each plant's
+// backlog in windows of rawCompactBatch (raw readings) or hourlyCompactBatch
+// (hourly summaries), one transaction per window. That keeps the locks each
+// transaction holds short, even on the first run over a large backlog. Both
+// are whole days, so windows stay aligned to the summary buckets.
+const (
+	rawCompactBatch    = 24 * time.Hour
+	hourlyCompactBatch = 30 * 24 * time.Hour
+)
+
+// logTier is a table compaction moves rows out of, and how.
+type logTier struct {
+	name        string
+	timeColumn  string
+	table       string
+	insertQuery string
+	batch       time.Duration
+}
+
+var (
+	rawLogTier = logTier{
+		name:       "raw readings",
+		timeColumn: "log_time",
+		table:      "plant_logs",
+		insertQuery: `INSERT INTO plant_logs_hourly (plant_id, log_type, bucket_start, min_value, max_value, sum_value, value_count)
+		 SELECT plant_id, log_type, DATE_FORMAT(log_time, '%Y-%m-%d %H:00:00') AS b,
+		        MIN(log_value), MAX(log_value), SUM(log_value), COUNT(*)
+		 FROM plant_logs WHERE plant_id = ? AND log_time >= ? AND log_time < ?
+		 GROUP BY plant_id, log_type, b
+		 ON DUPLICATE KEY UPDATE
+		   min_value = LEAST(min_value, VALUES(min_value)),
+		   max_value = GREATEST(max_value, VALUES(max_value)),
+		   sum_value = sum_value + VALUES(sum_value),
+		   value_count = value_count + VALUES(value_count)`,
+		batch: rawCompactBatch,
+	}
+	hourlyLogTier = logTier{
+		name:       "hourly summaries",
+		timeColumn: "bucket_start",
+		table:      "plant_logs_hourly",
+		insertQuery: `INSERT INTO plant_logs_daily (plant_id, log_type, bucket_start, min_value, max_value, sum_value, value_count)
+		 SELECT plant_id, log_type, DATE_FORMAT(bucket_start, '%Y-%m-%d 00:00:00') AS b,
+		        MIN(min_value), MAX(max_value), SUM(sum_value), SUM(value_count)
+		 FROM plant_logs_hourly WHERE plant_id = ? AND bucket_start >= ? AND bucket_start < ?
+		 GROUP BY plant_id, log_type, b
+		 ON DUPLICATE KEY UPDATE
+		   min_value = LEAST(min_value, VALUES(min_value)),
+		   max_value = GREATEST(max_value, VALUES(max_value)),
+		   sum_value = sum_value + VALUES(sum_value),
+		   value_count = value_count + VALUES(value_count)`,
+		batch: hourlyCompactBatch,
+	}
+)
+
+// compactPlantLogs moves readings past their retention into the next tier.
+// Each window is moved in a transaction, so every reading is counted in
+// exactly one tier at any time. Cutoffs are aligned to whole hours and days,
+// and summaries are merged into existing rows, so repeated runs don't double
+// count.
+func compactPlantLogs(now time.Time) error {
+	rawCutoff := now.UTC().Add(-rawLogRetention).Truncate(time.Hour)
+	if err := compactTier(rawLogTier, rawCutoff); err != nil {
+		return err
+	}
+	hourlyCutoff := now.UTC().Add(-hourlyLogRetention).Truncate(24 * time.Hour)
+	return compactTier(hourlyLogTier, hourlyCutoff)
+}
+
+// compactTier rolls up and deletes the rows of a tier older than cutoff,
+// plant by plant and window by window.
+func compactTier(t logTier, cutoff time.Time) error {
+	plantIDs, err := selectStrings("SELECT DISTINCT plant_id FROM "+t.table+" WHERE "+t.timeColumn+" < ?", cutoff)
+	if err != nil {
+		return fmt.Errorf("select plants with old %s: %w", t.name, err)
+	}
+
+	var rolled, deleted int64
+	for _, plantID := range plantIDs {
+		for {
+			var oldestStr sql.NullString
+			err := db.QueryRow(
+				"SELECT MIN("+t.timeColumn+") FROM "+t.table+" WHERE plant_id = ? AND "+t.timeColumn+" < ?",
+				plantID, cutoff,
+			).Scan(&oldestStr)
+			if err != nil {
+				return fmt.Errorf("select oldest %s of %s: %w", t.name, plantID, err)
+			}
+			oldest, err := parseNullDBTime(oldestStr)
+			if err != nil {
+				return err
+			}
+			if oldest == nil {
+				break
+			}
+			from := oldest.Truncate(t.batch)
+			to := from.Add(t.batch)
+			if to.After(cutoff) {
+				to = cutoff
+			}
+			r, d, err := rollUp(t, plantID, from, to)
+			if err != nil {
+				return fmt.Errorf("roll up %s of %s: %w", t.name, plantID, err)
+			}
+			rolled += r
+			deleted += d
+		}
+	}
+	if deleted > 0 {
+		log.Printf("retention: compacted %d %s before %s into %d rows", deleted, t.name, cutoff.Format(time.RFC3339), rolled)
+	}
+	return nil
+}
+
+// selectStrings runs a query returning a single string column.
+func selectStrings(query string, args ...interface{}) ([]string, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []string
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			return nil, err
+		}
+		out = append(out, s)
+	}
+	return out, rows.Err()
+}
+
+// rollUp summarizes a plant's rows of a tier in [from, to) into the next tier
+// and deletes them, in one transaction. It returns the rows affected by each.
+// For the upsert that counts 1 per new summary row and 2 per updated one.
+func rollUp(t logTier, plantID string, from, to time.Time) (int64, int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, 0, fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(t.insertQuery, plantID, from, to)
+	if err != nil {
+		return 0, 0, fmt.Errorf("insert summaries: %w", err)
+	}
+	rolled, _ := res.RowsAffected()
+
+	res, err = tx.Exec(
+		"DELETE FROM "+t.table+" WHERE plant_id = ? AND "+t.timeColumn+" >= ? AND "+t.timeColumn+" < ?",
+		plantID, from, to,
+	)
+	if err != nil {
+		return 0, 0, fmt.Errorf("delete rolled up rows: %w", err)
+	}
+	deleted, _ := res.RowsAffected()
+
+	if err := tx.Commit(); err != nil {
+		return 0, 0, fmt.Errorf("commit: %w", err)
+	}
+	return rolled, deleted, nil
+}
+
+// Queries returning (type, time, min, max, sum, count) rows of a plant between
+// two times from each tier, in time order. A summary is included if its
+// bucket overlaps the range, so the one containing the start isn't lost.
+const (
+	rawLogTierQuery = `SELECT log_type, log_time, log_value, log_value, log_value, 1 FROM plant_logs
+		WHERE plant_id = ? AND log_time BETWEEN ? AND ? ORDER BY log_time, log_type`
+	hourlyLogTierQuery = `SELECT log_type, bucket_start, min_value, max_value, sum_value, value_count FROM plant_logs_hourly
+		WHERE plant_id = ? AND bucket_start > DATE_SUB(?, INTERVAL 1 HOUR) AND bucket_start <= ? ORDER BY bucket_start, log_type`
+	dailyLogTierQuery = `SELECT log_type, bucket_start, min_value, max_value, sum_value, value_count FROM plant_logs_daily
+		WHERE plant_id = ? AND bucket_start > DATE_SUB(?, INTERVAL 1 DAY) AND bucket_start <= ? ORDER BY bucket_start, log_type`
+)
+
+// logTierQueries returns the queries for the tiers that may hold a plant's
+// readings from start onwards, oldest tier first. Compaction moves readings
+// from the oldest end of one tier to the next, so whatever is older than a
+// tier's oldest row is in a coarser one. This is worked out from the data
+// rather than the retention settings, which may have changed since the data
+// was compacted. Running the queries in order yields readings in (roughly)
+// time order.
+func logTierQueries(plantID string, start time.Time) ([]string, error) {
+	var rawOldestStr, hourlyOldestStr sql.NullString
+	if err := db.QueryRow("SELECT MIN(log_time) FROM plant_logs WHERE plant_id = ?", plantID).Scan(&rawOldestStr); err != nil {
+		return nil, fmt.Errorf("select oldest raw reading: %w", err)
+	}
+	if err := db.QueryRow("SELECT MIN(bucket_start) FROM plant_logs_hourly WHERE plant_id = ?", plantID).Scan(&hourlyOldestStr); err != nil {
+		return nil, fmt.Errorf("select oldest hourly summary: %w", err)
+	}
+	rawOldest, err := parseNullDBTime(rawOldestStr)
+	if err != nil {
+		return nil, err
+	}
+	hourlyOldest, err := parseNullDBTime(hourlyOldestStr)
+	if err != nil {
+		return nil, err
+	}
+
+	// A tier with no rows reaches back no further than the next finer one
+	finerOldest := rawOldest
+	if hourlyOldest != nil {
+		finerOldest = hourlyOldest
+	}
+	var queries []string
+	if finerOldest == nil || start.Before(*finerOldest) {
+		queries = append(queries, dailyLogTierQuery)
+	}
+	if hourlyOldest != nil && (rawOldest == nil || start.Before(*rawOldest)) {
+		queries = append(queries, hourlyLogTierQuery)
+	}
+	return append(queries, rawLogTierQuery), nil
+}
+
+// loadPlantLogs adds a plant's readings between start and end to agg, reading
+// the summary tiers only when the range reaches back far enough for them to
+// hold data.
+func loadPlantLogs(plantID string, start, end time.Time, agg *logAggregator) error {
+	queries, err := logTierQueries(plantID, start)
+	if err != nil {
+		return err
+	}
+	for _, q := range queries {
+		err := streamLogTier(plantID, start, end, q, func(s logSample) error {
+			agg.add(s)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// streamLogTier runs one of the tier queries and calls fn for each row, one at
+// a time. Rows of unknown sensor types are skipped. It stops at the first
+// error returned by fn.
+func streamLogTier(plantID string, start, end time.Time, query string, fn func(logSample) error) error {
+	rows, err := db.Query(query, plantID, start, end)
+	if err != nil {
+		return fmt.Errorf("query plant logs: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var s logSample
+		var timeStr string
+		if err := rows.Scan(&s.LogType, &timeStr, &s.Min, &s.Max, &s.Sum, &s.Count); err != nil {
+			return fmt.Errorf("scan plant log row: %w", err)
+		}
+		if s.Time, err = parseDBTime(timeStr); err != nil {
+			log.Printf("Unable to parse time string: %s", timeStr)
+			continue
+		}
+		if _, ok := sensorTypes.get(s.LogType); !ok {
+			log.Printf("Unknown log type in database: %v", s.LogType)
+			continue
+		}
+		if err := fn(s); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
@@ -0,0 +1,447 @@
+// `scheduler.go` contains scheduled and recurring commands, and the endpoints
+// a user uses to manage them
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+	_ "time/tzdata" // so time zones work even if the server has no tz database
+)
+
+// Kinds of schedule. The expression is interpreted according to the kind:
+//   - cron:     a 5-field cron expression, e.g. "0 7 * * *"
+//   - interval: a Go duration of at least minScheduleInterval, e.g. "12h"
+//   - once:     a local date and time, e.g. "2026-05-01T07:00"
+const (
+	scheduleCron     = "cron"
+	scheduleInterval = "interval"
+	scheduleOnce     = "once"
+)
+
+const minScheduleInterval = time.Minute
+
+// How often the scheduler looks for schedules that are due.
+const schedulerTick = 30 * time.Second
+
+// PlantSchedule is a single row of the plant_schedules table.
+type PlantSchedule struct {
+	ScheduleID int64      `json:"scheduleId"`
+	PlantID    string     `json:"plantId"`
+	Command    Command    `json:"command"`
+	Kind       string     `json:"kind"`
+	Expression string     `json:"expression"`
+	TimeZone   string     `json:"timeZone"`
+	Paused     bool       `json:"paused"`
+	NextRunAt  *time.Time `json:"nextRunAt,omitempty"`
+	LastRunAt  *time.Time `json:"lastRunAt,omitempty"`
+	CreatedAt  time.Time  `json:"createdAt"`
+}
+
+// nextScheduleRun returns the first time after `after` that a schedule should
+// fire, or the zero time if it will never fire again.
+func nextScheduleRun(kind, expression, timeZone string, after time.Time) (time.Time, error) {
+	loc, err := time.LoadLocation(timeZone)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time zone %q", timeZone)
+	}
+	switch kind {
+	case scheduleCron:
+		c, err := parseCron(expression)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return c.next(after, loc), nil
+	case scheduleInterval:
+		d, err := time.ParseDuration(expression)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid interval %q", expression)
+		}
+		if d < minScheduleInterval {
+			return time.Time{}, fmt.Errorf("interval must be at least %v", minScheduleInterval)
+		}
+		return after.Add(d), nil
+	case scheduleOnce:
+		t, err := time.ParseInLocation("2006-01-02T15:04", expression, loc)
+		if err != nil {
+			if t, err = time.Parse(time.RFC3339, expression); err != nil {
+				return time.Time{}, fmt.Errorf("invalid time %q, expected YYYY-MM-DDTHH:MM", expression)
+			}
+		}
+		if !t.After(after) {
+			return time.Time{}, nil
+		}
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("unknown schedule kind %q", kind)
+}
+
+// nullableTime converts the zero time to NULL for storing in the database.
+func nullableTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t.UTC()
+}
+
+// runScheduler fires due schedules forever. It is started from main.
+func runScheduler() {
+	ticker := time.NewTicker(schedulerTick)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := runDueSchedules(time.Now()); err != nil {
+			log.Printf("scheduler: %v", err)
+		}
+	}
+}
+
+// runDueSchedules issues the command of every unpaused schedule whose next run
+// is at or before now, then works out when each should run next. Runs missed
+// while the server was down fire once, not once per missed occurrence.
+func runDueSchedules(now time.Time) error {
+	rows, err := db.Query(
+		`SELECT s.schedule_id, s.plant_id, s.command, s.kind, s.expression, s.time_zone, p.plant_type
+		 FROM plant_schedules s JOIN plants p ON p.plant_id = s.plant_id
+		 WHERE s.paused = 0 AND s.next_run_at IS NOT NULL AND s.next_run_at <= ?`,
+		now.UTC(),
+	)
+	if err != nil {
+		return fmt.Errorf("select due schedules: %w", err)
+	}
+
+	type dueSchedule struct {
+		PlantSchedule
+		plantType string
+	}
+	var due []dueSchedule
+	for rows.Next() {
+		var s dueSchedule
+		var commandStr string
+		var plantType sql.NullString
+		if err := rows.Scan(&s.ScheduleID, &s.PlantID, &commandStr, &s.Kind, &s.Expression, &s.TimeZone, &plantType); err != nil {
+			rows.Close()
+			return fmt.Errorf("scan schedule: %w", err)
+		}
+		s.Command = decodeStoredCommand(commandStr)
+		s.plantType = plantType.String
+		due = append(due, s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("iterate schedules: %w", err)
+	}
+
+	for _, s := range due {
+		if command, err := validateCommand(s.plantType, s.Command); err != nil {
+			log.Printf("scheduler: schedule %d has an invalid command: %v", s.ScheduleID, err)
+		} else if cmd, err := issueCommand(s.PlantID, command); err != nil {
+			log.Printf("scheduler: error issuing command for schedule %d: %v", s.ScheduleID, err)
+			continue // try again next tick
+		} else {
+			log.Printf("scheduler: schedule %d queued command %d for %s", s.ScheduleID, cmd.CommandID, s.PlantID)
+		}
+
+		next, err := nextScheduleRun(s.Kind, s.Expression, s.TimeZone, now)
+		if err != nil {
+			log.Printf("scheduler: schedule %d can't be rescheduled: %v", s.ScheduleID, err)
+		}
+		if _, err := db.Exec(
+			"UPDATE plant_schedules SET last_run_at = ?, next_run_at = ? WHERE schedule_id = ?",
+			now.UTC().Truncate(time.Second), nullableTime(next), s.ScheduleID,
+		); err != nil {
+			log.Printf("scheduler: error updating schedule %d: %v", s.ScheduleID, err)
+		}
+	}
+	return nil
+}
+
+// verifyScheduleOwnership checks that a schedule exists and is for one of the
+// user's plants. If not, it writes an error response and returns false.
+func verifyScheduleOwnership(w http.ResponseWriter, userID int, scheduleID int64) bool {
+	var plantID string
+	err := db.QueryRow("SELECT plant_id FROM plant_schedules WHERE schedule_id = ?", scheduleID).Scan(&plantID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "schedule not found", http.StatusNotFound)
+		return false
+	} else if err != nil {
+		log.Printf("Error looking up schedule: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return false
+	}
+	return verifyPlantOwnership(w, userID, plantID)
+}
+
+// Request body for creating a schedule
+type createScheduleRequest struct {
+	PlantID    string  `json:"plantId"`
+	Command    Command `json:"command"`
+	Kind       string  `json:"kind"`
+	Expression string  `json:"expression"`
+	TimeZone   string  `json:"timeZone"`
+}
+
+// handleCreateSchedule lets a user schedule a command for one of their plants.
+// Expects POST JSON body:
+//
+//	{
+//	    "plantId": "string",
+//	    "command": { "name": "water", "args": { "durationMs": 3000 } },
+//	    "kind": "cron" | "interval" | "once",
+//	    "expression": "0 7 * * *",
+//	    "timeZone": "America/Los_Angeles"   // defaults to UTC
+//	}
+func handleCreateSchedule(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, ok := getSessionUserID(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req createScheduleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.PlantID == "" || req.Kind == "" || req.Expression == "" {
+		http.Error(w, "plantId, kind and expression are required", http.StatusBadRequest)
+		return
+	}
+	if req.TimeZone == "" {
+		req.TimeZone = "UTC"
+	}
+
+	if !verifyPlantOwnership(w, userID, req.PlantID) {
+		return
+	}
+
+	plantType, err := getPlantType(req.PlantID)
+	if err != nil {
+		log.Printf("Error getting plant type: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	command, err := validateCommand(plantType, req.Command)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	next, err := nextScheduleRun(req.Kind, req.Expression, req.TimeZone, now)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if next.IsZero() {
+		http.Error(w, "schedule would never run", http.StatusBadRequest)
+		return
+	}
+
+	encoded, err := json.Marshal(command)
+	if err != nil {
+		log.Printf("Error encoding command: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	res, err := db.Exec(
+		`INSERT INTO plant_schedules (plant_id, command, kind, expression, time_zone, paused, next_run_at, created_at)
+		 VALUES (?, ?, ?, ?, ?, 0, ?, ?)`,
+		req.PlantID, string(encoded), req.Kind, req.Expression, req.TimeZone, next.UTC(), now,
+	)
+	if err != nil {
+		log.Printf("Error inserting schedule: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	id, _ := res.LastInsertId()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(PlantSchedule{
+		ScheduleID: id,
+		PlantID:    req.PlantID,
+		Command:    command,
+		Kind:       req.Kind,
+		Expression: req.Expression,
+		TimeZone:   req.TimeZone,
+		NextRunAt:  &next,
+		CreatedAt:  now,
+	})
+}
+
+// handleGetSchedules lists the schedules of one of the user's plants.
+// Expects GET with query parameter plantId.
+func handleGetSchedules(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, ok := getSessionUserID(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	plantID := r.URL.Query().Get("plantId")
+	if plantID == "" {
+		http.Error(w, "plantId is required", http.StatusBadRequest)
+		return
+	}
+
+	if !verifyPlantOwnership(w, userID, plantID) {
+		return
+	}
+
+	rows, err := db.Query(
+		`SELECT schedule_id, command, kind, expression, time_zone, paused, next_run_at, last_run_at, created_at
+		 FROM plant_schedules WHERE plant_id = ? ORDER BY schedule_id`,
+		plantID,
+	)
+	if err != nil {
+		log.Printf("Error querying schedules: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	schedules := make([]PlantSchedule, 0)
+	for rows.Next() {
+		s := PlantSchedule{PlantID: plantID}
+		var commandStr, createdStr string
+		var nextStr, lastStr sql.NullString
+		if err := rows.Scan(&s.ScheduleID, &commandStr, &s.Kind, &s.Expression, &s.TimeZone, &s.Paused, &nextStr, &lastStr, &createdStr); err != nil {
+			log.Printf("Error scanning schedule row: %v", err)
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+		s.Command = decodeStoredCommand(commandStr)
+		if s.NextRunAt, err = parseNullDBTime(nextStr); err == nil {
+			if s.LastRunAt, err = parseNullDBTime(lastStr); err == nil {
+				s.CreatedAt, err = parseDBTime(createdStr)
+			}
+		}
+		if err != nil {
+			log.Printf("Error parsing schedule times: %v", err)
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+		schedules = append(schedules, s)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(schedules)
+}
+
+// Request body for pausing or resuming a schedule
+type pauseScheduleRequest struct {
+	ScheduleID int64 `json:"scheduleId"`
+	Paused     bool  `json:"paused"`
+}
+
+// handlePauseSchedule pauses or resumes one of the user's schedules.
+// Expects POST JSON body: { "scheduleId": <id>, "paused": <bool> }
+// Resuming works out the next run from the current time, so occurrences
+// missed while paused are skipped.
+func handlePauseSchedule(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, ok := getSessionUserID(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req pauseScheduleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if !verifyScheduleOwnership(w, userID, req.ScheduleID) {
+		return
+	}
+
+	if req.Paused {
+		_, err := db.Exec("UPDATE plant_schedules SET paused = 1 WHERE schedule_id = ?", req.ScheduleID)
+		if err != nil {
+			log.Printf("Error pausing schedule: %v", err)
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+	} else {
+		var kind, expression, timeZone string
+		err := db.QueryRow("SELECT kind, expression, time_zone FROM plant_schedules WHERE schedule_id = ?", req.ScheduleID).Scan(&kind, &expression, &timeZone)
+		if err != nil {
+			log.Printf("Error looking up schedule: %v", err)
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+		next, err := nextScheduleRun(kind, expression, timeZone, time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		_, err = db.Exec("UPDATE plant_schedules SET paused = 0, next_run_at = ? WHERE schedule_id = ?", nullableTime(next), req.ScheduleID)
+		if err != nil {
+			log.Printf("Error resuming schedule: %v", err)
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]bool{"paused": req.Paused})
+}
+
+// Request body for deleting a schedule
+type deleteScheduleRequest struct {
+	ScheduleID int64 `json:"scheduleId"`
+}
+
+// handleDeleteSchedule deletes one of the user's schedules.
+// Expects POST JSON body: { "scheduleId": <id> }
+func handleDeleteSchedule(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, ok := getSessionUserID(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req deleteScheduleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if !verifyScheduleOwnership(w, userID, req.ScheduleID) {
+		return
+	}
+
+	if _, err := db.Exec("DELETE FROM plant_schedules WHERE schedule_id = ?", req.ScheduleID); err != nil {
+		log.Printf("Error deleting schedule: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"status": "deleted"})
+}
@@ -0,0 +1,210 @@
+// `sensors.go` contains the registry of sensor types plants can log readings for
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"sync"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// SensorType describes a kind of reading a plant can log, e.g. "moisture".
+// Min and Max are the range readings are expected in; readings outside it are
+// stored anyway, with a warning in the server log.
+type SensorType struct {
+	Name        string   `json:"name"`
+	DisplayName string   `json:"displayName"`
+	Unit        string   `json:"unit"`
+	Min         *float64 `json:"min,omitempty"`
+	Max         *float64 `json:"max,omitempty"`
+	Precision   int      `json:"precision"`
+}
+
+// round rounds a value to the sensor's precision (number of decimal places).
+func (s SensorType) round(v float64) float64 {
+	p := math.Pow(10, float64(s.Precision))
+	return math.Round(v*p) / p
+}
+
+// defaultSensorTypes are used until the sensor_types table has been loaded,
+// and if it can't be. They match the types plants have always logged.
+var defaultSensorTypes = []SensorType{
+	{Name: "light", DisplayName: "Light Intensity", Unit: "lux", Min: floatPtr(0), Precision: 0},
+	{Name: "temp", DisplayName: "Temperature", Unit: "°C", Min: floatPtr(-40), Max: floatPtr(85), Precision: 1},
+	{Name: "moisture", DisplayName: "Soil Moisture", Unit: "%", Min: floatPtr(0), Max: floatPtr(100), Precision: 1},
+}
+
+// sensorRegistry is an in-memory copy of the sensor_types table. It is safe for
+// concurrent use.
+type sensorRegistry struct {
+	mu    sync.RWMutex
+	types map[string]SensorType
+}
+
+var sensorTypes = newSensorRegistry(defaultSensorTypes)
+
+func newSensorRegistry(types []SensorType) *sensorRegistry {
+	r := &sensorRegistry{}
+	r.set(types)
+	return r
+}
+
+func (r *sensorRegistry) set(types []SensorType) {
+	m := make(map[string]SensorType, len(types))
+	for _, t := range types {
+		m[t.Name] = t
+	}
+	r.mu.Lock()
+	r.types = m
+	r.mu.Unlock()
+}
+
+func (r *sensorRegistry) get(name string) (SensorType, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	t, ok := r.types[name]
+	return t, ok
+}
+
+// all returns every sensor type, sorted by name.
+func (r *sensorRegistry) all() []SensorType {
+	r.mu.RLock()
+	out := make([]SensorType, 0, len(r.types))
+	for _, t := range r.types {
+		out = append(out, t)
+	}
+	r.mu.RUnlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// loadSensorTypes replaces the registry with the contents of the sensor_types
+// table. An empty table is treated as an error so the registry keeps the
+// defaults rather than rejecting every reading.
+func loadSensorTypes() error {
+	rows, err := db.Query("SELECT type_name, display_name, unit, min_value, max_value, value_precision FROM sensor_types")
+	if err != nil {
+		return fmt.Errorf("select sensor types: %w", err)
+	}
+	defer rows.Close()
+
+	var types []SensorType
+	for rows.Next() {
+		var t SensorType
+		var min, max sql.NullFloat64
+		if err := rows.Scan(&t.Name, &t.DisplayName, &t.Unit, &min, &max, &t.Precision); err != nil {
+			return fmt.Errorf("scan sensor type: %w", err)
+		}
+		t.Min, t.Max = nullFloatPtr(min), nullFloatPtr(max)
+		types = append(types, t)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("iterate sensor types: %w", err)
+	}
+	if len(types) == 0 {
+		return fmt.Errorf("sensor_types table is empty")
+	}
+	sensorTypes.set(types)
+	return nil
+}
+
+// nullFloatPtr converts a nullable DOUBLE column to a pointer, nil for NULL.
+func nullFloatPtr(n sql.NullFloat64) *float64 {
+	if !n.Valid {
+		return nil
+	}
+	return &n.Float64
+}
+
+// handleGetSensorTypes lists the sensor types, so the dashboard knows how to
+// label and chart each kind of reading.
+func handleGetSensorTypes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if _, ok := getSessionUserID(r); !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sensorTypes.all())
+}
+
+var sensorTypeNameRe = regexp.MustCompile(`^[a-z][a-z0-9_]{0,49}$`)
+
+// handleAddSensorType lets an admin add a new sensor type without a redeploy.
+// Expects POST JSON body:
+//
+//	{
+//	    "name": "humidity",           // lowercase letters, digits and _
+//	    "displayName": "Air Humidity",
+//	    "unit": "%",
+//	    "min": 0,                      // optional
+//	    "max": 100,                    // optional
+//	    "precision": 1                 // decimal places
+//	}
+func handleAddSensorType(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if _, ok := requireAdmin(w, r); !ok {
+		return
+	}
+
+	var req SensorType
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if !sensorTypeNameRe.MatchString(req.Name) {
+		http.Error(w, "name must be lowercase letters, digits and underscores", http.StatusBadRequest)
+		return
+	}
+	if req.DisplayName == "" {
+		req.DisplayName = req.Name
+	}
+	if req.Min != nil && req.Max != nil && *req.Min > *req.Max {
+		http.Error(w, "min must not be greater than max", http.StatusBadRequest)
+		return
+	}
+	if req.Precision < 0 || req.Precision > 6 {
+		http.Error(w, "precision must be between 0 and 6", http.StatusBadRequest)
+		return
+	}
+
+	_, err := db.Exec(
+		"INSERT INTO sensor_types (type_name, display_name, unit, min_value, max_value, value_precision) VALUES (?, ?, ?, ?, ?, ?)",
+		req.Name, req.DisplayName, req.Unit, req.Min, req.Max, req.Precision,
+	)
+	if mysqlErr, ok := err.(*mysql.MySQLError); ok && mysqlErr.Number == 1062 {
+		http.Error(w, "sensor type already exists", http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Printf("Error inserting sensor type: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := loadSensorTypes(); err != nil {
+		log.Printf("Error reloading sensor types: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(req)
+}
@@ -0,0 +1,309 @@
+// `sessions.go` contains the server-side login sessions. The session cookie
+// holds an opaque random token; the sessions table holds its hash, so a
+// session can be listed and revoked, and a leaked database can't be used to
+// forge cookies.
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// sessionLifetime is how long a session lasts after login. It is set from the
+// environment in main.
+var sessionLifetime = 24 * time.Hour
+
+// sessionTouchInterval limits how often a session's last_used_at is written.
+const sessionTouchInterval = time.Minute
+
+// Session is a logged in browser, as listed to its user.
+type Session struct {
+	SessionID  int64     `json:"sessionId"`
+	UserAgent  string    `json:"userAgent"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"createdAt"`
+	LastUsedAt time.Time `json:"lastUsedAt"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+	Current    bool      `json:"current"`
+}
+
+// newToken returns a random URL-safe token, for session cookies and emailed
+// links.
+func newToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generate token: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashToken returns the hex SHA-256 of a token, which is what the database
+// stores. The tokens are random, so they don't need a slow hash.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// clientIP returns the address a request came from. X-Forwarded-For is only
+// believed when the request comes from the reverse proxy on this host.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+			// The proxy appends the address it saw to the list
+			parts := strings.Split(fwd, ",")
+			return strings.TrimSpace(parts[len(parts)-1])
+		}
+	}
+	return host
+}
+
+// truncate cuts s to at most n bytes, to fit a VARCHAR column. It cuts on a
+// character boundary and replaces invalid UTF-8, either of which a utf8mb4
+// column would reject.
+func truncate(s string, n int) string {
+	s = strings.ToValidUTF8(s, "\uFFFD")
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// createSession starts a session for a user and returns its cookie token.
+func createSession(r *http.Request, userID int) (string, error) {
+	token, err := newToken()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	_, err = db.Exec(
+		`INSERT INTO sessions (token_hash, user_id, user_agent, ip, created_at, last_used_at, expires_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		hashToken(token), userID, truncate(r.UserAgent(), 255), clientIP(r), now, now, now.Add(sessionLifetime),
+	)
+	if err != nil {
+		return "", fmt.Errorf("insert session: %w", err)
+	}
+	return token, nil
+}
+
+// sessionToken returns the session token in a request's cookie.
+func sessionToken(r *http.Request) (string, bool) {
+	c, err := r.Cookie(cookieName)
+	if err != nil {
+		return "", false
+	}
+	var value map[string]string
+	if err = secCookie.Decode(cookieName, c.Value, &value); err != nil {
+		return "", false
+	}
+	token, ok := value["session"]
+	return token, ok && token != ""
+}
+
+// lookupSession returns the user and ID of the live session with a token,
+// and notes that it has been used.
+func lookupSession(token string) (userID int, sessionID int64, ok bool) {
+	var lastUsedStr string
+	now := time.Now().UTC()
+	err := db.QueryRow(
+		"SELECT session_id, user_id, last_used_at FROM sessions WHERE token_hash = ? AND expires_at > ?",
+		hashToken(token), now,
+	).Scan(&sessionID, &userID, &lastUsedStr)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Error looking up session: %v", err)
+		}
+		return 0, 0, false
+	}
+
+	if lastUsed, err := parseDBTime(lastUsedStr); err == nil && now.Sub(lastUsed) >= sessionTouchInterval {
+		if _, err := db.Exec("UPDATE sessions SET last_used_at = ? WHERE session_id = ?", now.Truncate(time.Second), sessionID); err != nil {
+			log.Printf("Error updating session %d: %v", sessionID, err)
+		}
+	}
+	return userID, sessionID, true
+}
+
+// revokeUserSessions ends all of a user's sessions, except the one with ID
+// keep if it is nonzero.
+func revokeUserSessions(userID int, keep int64) error {
+	if _, err := db.Exec("DELETE FROM sessions WHERE user_id = ? AND session_id <> ?", userID, keep); err != nil {
+		return fmt.Errorf("delete sessions of user %d: %w", userID, err)
+	}
+	return nil
+}
+
+// deleteExpiredSessions removes sessions past their expiry. It is run by the
+// retention job.
+func deleteExpiredSessions(now time.Time) error {
+	if _, err := db.Exec("DELETE FROM sessions WHERE expires_at <= ?", now.UTC()); err != nil {
+		return fmt.Errorf("delete expired sessions: %w", err)
+	}
+	return nil
+}
+
+// handleGetSessions lists the logged in user's active sessions, most recently
+// used first. The session the request is made in has "current": true.
+func handleGetSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token, ok := sessionToken(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	userID, currentID, ok := lookupSession(token)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	rows, err := db.Query(
+		`SELECT session_id, user_agent, ip, created_at, last_used_at, expires_at
+		 FROM sessions WHERE user_id = ? AND expires_at > ? ORDER BY last_used_at DESC`,
+		userID, time.Now().UTC(),
+	)
+	if err != nil {
+		log.Printf("Error querying sessions: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		var s Session
+		var userAgent, ip sql.NullString
+		var createdStr, lastUsedStr, expiresStr string
+		if err := rows.Scan(&s.SessionID, &userAgent, &ip, &createdStr, &lastUsedStr, &expiresStr); err != nil {
+			log.Printf("Error scanning session row: %v", err)
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+		s.UserAgent, s.IP, s.Current = userAgent.String, ip.String, s.SessionID == currentID
+		if s.CreatedAt, err = parseDBTime(createdStr); err == nil {
+			if s.LastUsedAt, err = parseDBTime(lastUsedStr); err == nil {
+				s.ExpiresAt, err = parseDBTime(expiresStr)
+			}
+		}
+		if err != nil {
+			log.Printf("Error parsing session times: %v", err)
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+		sessions = append(sessions, s)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sessions)
+}
+
+// handleRevokeSession ends one of the logged in user's sessions. Revoking the
+// current session also clears its cookie, like logging out.
+// Expects POST JSON body: { "sessionId": <id> }
+func handleRevokeSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token, ok := sessionToken(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	userID, currentID, ok := lookupSession(token)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		SessionID int64 `json:"sessionId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	res, err := db.Exec("DELETE FROM sessions WHERE session_id = ? AND user_id = ?", req.SessionID, userID)
+	if err != nil {
+		log.Printf("Error revoking session: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+	if req.SessionID == currentID {
+		clearSessionCookie(w)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleRevokeAllSessions logs the user out everywhere. With
+// { "exceptCurrent": true } the session the request is made in is kept.
+// Expects POST, with an optional JSON body.
+func handleRevokeAllSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token, ok := sessionToken(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	userID, currentID, ok := lookupSession(token)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		ExceptCurrent bool `json:"exceptCurrent"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var keep int64
+	if req.ExceptCurrent {
+		keep = currentID
+	}
+	if err := revokeUserSessions(userID, keep); err != nil {
+		log.Printf("Error revoking sessions: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if !req.ExceptCurrent {
+		clearSessionCookie(w)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
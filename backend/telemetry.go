@@ -0,0 +1,240 @@
+// `telemetry.go` contains batch ingestion of plant readings and the handling of
+// device-supplied timestamps
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Readings may carry a device timestamp. It is accepted if it is no more than
+// maxClockSkew in the future (to allow for clock drift) and no more than
+// maxLogAge in the past (readings buffered while offline). Both are set from
+// the environment in main.
+var (
+	maxClockSkew = 5 * time.Minute
+	maxLogAge    = 7 * 24 * time.Hour
+)
+
+// maxLogBatch is the most entries accepted by a single batch request.
+const maxLogBatch = 1000
+
+// deviceTimestamp is a time sent by a plant, either as an RFC 3339 string or
+// as a number of seconds since the Unix epoch.
+type deviceTimestamp struct {
+	time.Time
+}
+
+func (t *deviceTimestamp) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+	s := string(data)
+	if len(data) > 0 && data[0] == '"' {
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+	}
+	ts, err := parseDeviceTimestamp(s)
+	if err != nil {
+		return err
+	}
+	*t = ts
+	return nil
+}
+
+// parseDeviceTimestamp parses an RFC 3339 time or a number of unix seconds.
+func parseDeviceTimestamp(s string) (deviceTimestamp, error) {
+	if secs, err := strconv.ParseFloat(s, 64); err == nil {
+		return deviceTimestamp{time.Unix(0, int64(secs*float64(time.Second))).UTC()}, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return deviceTimestamp{}, fmt.Errorf("invalid timestamp %q", s)
+	}
+	return deviceTimestamp{t}, nil
+}
+
+// resolveLogTime works out the time to store a reading under:
+//   - Readings without a timestamp are stamped with now.
+//   - If the device also says what its clock read when it sent the request
+//     (sentAt), the timestamp is shifted by the difference between that and
+//     now, which corrects for a device clock that is set wrong.
+//   - Timestamps up to maxClockSkew in the future are clamped to now; ones
+//     further in the future are rejected.
+//   - Timestamps more than maxLogAge in the past are rejected.
+func resolveLogTime(ts, sentAt *deviceTimestamp, now time.Time) (time.Time, error) {
+	if ts == nil || ts.IsZero() {
+		return now, nil
+	}
+	t := ts.Time
+	if sentAt != nil && !sentAt.IsZero() {
+		t = t.Add(now.Sub(sentAt.Time))
+	}
+	if t.After(now) {
+		if t.After(now.Add(maxClockSkew)) {
+			return time.Time{}, fmt.Errorf("timestamp is more than %v in the future", maxClockSkew)
+		}
+		t = now
+	}
+	if t.Before(now.Add(-maxLogAge)) {
+		return time.Time{}, fmt.Errorf("timestamp is more than %v in the past", maxLogAge)
+	}
+	return t, nil
+}
+
+// plantLogRow is a validated reading ready to be stored.
+type plantLogRow struct {
+	LogType  string
+	LogValue float64
+	LogTime  time.Time
+}
+
+// insertPlantLogBatch stores readings that have already been validated in a
+// single transaction.
+func insertPlantLogBatch(plantID string, entries []plantLogRow) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare("INSERT INTO plant_logs (plant_id, log_type, log_time, log_value) VALUES (?, ?, ?, ?)")
+	if err != nil {
+		return fmt.Errorf("prepare: %w", err)
+	}
+	defer stmt.Close()
+
+	for _, e := range entries {
+		if _, err := stmt.Exec(plantID, e.LogType, e.LogTime, e.LogValue); err != nil {
+			return fmt.Errorf("insert plant log: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+
+	for _, e := range entries {
+		events.publish(plantID, eventLog, logEvent{LogType: e.LogType, Entry: PlantLogEntry{Val: e.LogValue, Time: e.LogTime.UTC().Truncate(time.Second)}})
+	}
+	evaluateAlertsBatch(plantID, entries)
+	return nil
+}
+
+// A single entry of a batch request
+type plantLogBatchEntry struct {
+	LogType   string           `json:"logType"`
+	LogValue  float64          `json:"logValue"`
+	Timestamp *deviceTimestamp `json:"timestamp"`
+}
+
+type plantLogBatchError struct {
+	Index int    `json:"index"`
+	Error string `json:"error"`
+}
+
+// handlePlantLogBatch allows a plant (authenticated via cookies) to upload many
+// readings at once, e.g. ones buffered while it was offline. Expects a JSON
+// array body:
+//
+//	[ { "logType": "<type>", "logValue": <number>, "timestamp": <RFC 3339 or unix seconds> }, ... ]
+//
+// The timestamp is optional and defaults to the server's time. The optional
+// query parameter sentAt gives the device's clock when it sent the request
+// and is used to correct the timestamps (see resolveLogTime). Valid entries
+// are stored in one transaction; invalid ones are skipped and reported by
+// their index in the response: { "inserted": <n>, "errors": [ { "index": <i>, "error": "..." } ] }
+func handlePlantLogBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ok, plantID := verifyPlantCreds(w, r)
+	if !ok {
+		return
+	}
+
+	var req []plantLogBatchEntry
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	if len(req) > maxLogBatch {
+		http.Error(w, fmt.Sprintf("at most %d entries per batch", maxLogBatch), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var sentAt *deviceTimestamp
+	if v := r.URL.Query().Get("sentAt"); v != "" {
+		ts, err := parseDeviceTimestamp(v)
+		if err != nil {
+			http.Error(w, "invalid sentAt", http.StatusBadRequest)
+			return
+		}
+		sentAt = &ts
+	}
+
+	now := time.Now()
+	rows := make([]plantLogRow, 0, len(req))
+	entryErrors := make([]plantLogBatchError, 0)
+	for i, e := range req {
+		if err := validatePlantLog(plantID, e.LogType, e.LogValue); err != nil {
+			entryErrors = append(entryErrors, plantLogBatchError{Index: i, Error: err.Error()})
+			continue
+		}
+		logTime, err := resolveLogTime(e.Timestamp, sentAt, now)
+		if err != nil {
+			entryErrors = append(entryErrors, plantLogBatchError{Index: i, Error: err.Error()})
+			continue
+		}
+		rows = append(rows, plantLogRow{LogType: e.LogType, LogValue: e.LogValue, LogTime: logTime})
+	}
+
+	if len(rows) > 0 {
+		if err := insertPlantLogBatch(plantID, rows); err != nil {
+			log.Printf("error inserting plant log batch: %v", err)
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{"inserted": len(rows), "errors": entryErrors})
+}
+
+// handleTimeSync lets a device learn the server's clock so it can set its own
+// and see how far off it is. It needs no credentials. An optional query
+// parameter deviceTime (RFC 3339 or unix seconds) is the device's current
+// clock; the response then includes skewMs, the amount to add to the device
+// clock to match the server.
+func handleTimeSync(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	now := time.Now().UTC()
+	resp := map[string]interface{}{
+		"serverTime":     now.Format(time.RFC3339Nano),
+		"serverUnixMs":   now.UnixMilli(),
+		"maxClockSkewMs": maxClockSkew.Milliseconds(),
+		"maxLogAgeMs":    maxLogAge.Milliseconds(),
+	}
+
+	if v := r.URL.Query().Get("deviceTime"); v != "" {
+		deviceTime, err := parseDeviceTimestamp(v)
+		if err != nil {
+			http.Error(w, "invalid deviceTime", http.StatusBadRequest)
+			return
+		}
+		resp["skewMs"] = now.Sub(deviceTime.Time).Milliseconds()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
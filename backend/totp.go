@@ -0,0 +1,602 @@
+// `totp.go` contains the optional second login factor: time-based one-time
+// passwords (RFC 6238) from an authenticator app, with one-time recovery
+// codes for when the app is lost.
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// TOTP parameters. These are the defaults authenticator apps assume.
+const (
+	totpIssuer     = "Potbot"
+	totpDigits     = 6
+	totpPeriod     = 30      // seconds
+	totpModulus    = 1000000 // 10^totpDigits
+	totpSecretSize = 20      // bytes, the size of a SHA-1 HMAC key
+	// Codes from this many periods either side of now are accepted, to
+	// allow for clock drift and slow typing.
+	totpSkew = 1
+)
+
+// recoveryCodeCount is how many recovery codes a user is given.
+const recoveryCodeCount = 10
+
+// A login token carries a user from the password step of a login to the TOTP
+// step. It is only stored hashed, in the login_challenges table. It works for
+// loginTokenLifetime and at most loginTokenMaxAttempts codes, after which the
+// user has to enter their password again.
+const (
+	loginTokenLifetime    = 5 * time.Minute
+	loginTokenMaxAttempts = 5
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// totpCode returns the code for a secret at a time step (RFC 4226 section 5).
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%totpModulus)
+}
+
+// totpStep returns the time step a time falls in.
+func totpStep(t time.Time) int64 {
+	return t.Unix() / totpPeriod
+}
+
+// matchTOTP returns the step within totpSkew of now that code is valid for,
+// if any.
+func matchTOTP(secret, code string, now time.Time) (int64, bool) {
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+	current := totpStep(now)
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if hmac.Equal([]byte(totpCode(key, step)), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// totpProvisioningURI returns the otpauth URI authenticator apps read from a
+// QR code to add an account.
+func totpProvisioningURI(secret, accountName string) string {
+	label := url.PathEscape(totpIssuer + ":" + accountName)
+	q := url.Values{}
+	q.Set("secret", secret)
+	q.Set("issuer", totpIssuer)
+	q.Set("algorithm", "SHA1")
+	q.Set("digits", strconv.Itoa(totpDigits))
+	q.Set("period", strconv.Itoa(totpPeriod))
+	return "otpauth://totp/" + label + "?" + q.Encode()
+}
+
+// newRecoveryCodes returns a fresh set of recovery codes, formatted like
+// "abcde-fghij".
+func newRecoveryCodes() ([]string, error) {
+	// 32 characters, so every byte maps to one without bias
+	const charset = "abcdefghijklmnopqrstuvwxyz234567"
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 10)
+		if _, err := rand.Read(b); err != nil {
+			return nil, fmt.Errorf("generate recovery code: %w", err)
+		}
+		for j := range b {
+			b[j] = charset[b[j]%32]
+		}
+		codes[i] = string(b[:5]) + "-" + string(b[5:])
+	}
+	return codes, nil
+}
+
+// normalizeRecoveryCode makes a recovery code typed by a user comparable to
+// the one given to them.
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	code = strings.ReplaceAll(code, " ", "")
+	if len(code) == 10 && !strings.Contains(code, "-") {
+		code = code[:5] + "-" + code[5:]
+	}
+	return code
+}
+
+// replaceRecoveryCodes stores new recovery codes for a user, replacing any old
+// ones, and returns them.
+func replaceRecoveryCodes(tx *sql.Tx, userID int) ([]string, error) {
+	codes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec("DELETE FROM totp_recovery_codes WHERE user_id = ?", userID); err != nil {
+		return nil, fmt.Errorf("delete recovery codes: %w", err)
+	}
+	for _, c := range codes {
+		if _, err := tx.Exec("INSERT INTO totp_recovery_codes (user_id, code_hash) VALUES (?, ?)", userID, hashToken(c)); err != nil {
+			return nil, fmt.Errorf("insert recovery code: %w", err)
+		}
+	}
+	return codes, nil
+}
+
+// checkSecondFactor checks a code from a user's authenticator app, or one of
+// their recovery codes, and uses it up so it can't be entered again.
+func checkSecondFactor(userID int, code string, now time.Time) (bool, error) {
+	code = strings.TrimSpace(code)
+	if len(code) == totpDigits {
+		var secret sql.NullString
+		if err := db.QueryRow("SELECT totp_secret FROM users WHERE user_id = ? AND totp_enabled = 1", userID).Scan(&secret); err != nil {
+			return false, fmt.Errorf("select totp secret: %w", err)
+		}
+		step, ok := matchTOTP(secret.String, code, now)
+		if !ok {
+			return false, nil
+		}
+		// A code can't be used twice, nor can one older than the last used
+		res, err := db.Exec(
+			"UPDATE users SET totp_last_step = ? WHERE user_id = ? AND (totp_last_step IS NULL OR totp_last_step < ?)",
+			step, userID, step,
+		)
+		if err != nil {
+			return false, fmt.Errorf("update totp step: %w", err)
+		}
+		n, _ := res.RowsAffected()
+		return n == 1, nil
+	}
+
+	res, err := db.Exec(
+		"UPDATE totp_recovery_codes SET used_at = ? WHERE user_id = ? AND code_hash = ? AND used_at IS NULL",
+		now.Truncate(time.Second), userID, hashToken(normalizeRecoveryCode(code)),
+	)
+	if err != nil {
+		return false, fmt.Errorf("use recovery code: %w", err)
+	}
+	n, _ := res.RowsAffected()
+	return n == 1, nil
+}
+
+// checkUserPassword reports whether password is a user's password.
+func checkUserPassword(userID int, password string) (bool, error) {
+	var hash string
+	if err := db.QueryRow("SELECT password_hash FROM users WHERE user_id = ?", userID).Scan(&hash); err != nil {
+		return false, fmt.Errorf("select password hash: %w", err)
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil, nil
+}
+
+// reservePasswordCheck counts a check of the logged in user's password
+// towards the lockouts in lockout.go, like a login. If they or their IP are
+// locked out it writes the response and returns false. Once the check has
+// passed, the attempt is forgiven with forgivePasswordCheck.
+func reservePasswordCheck(w http.ResponseWriter, userID int, ip string, now time.Time) bool {
+	if until, ok := loginIPs.reserve(ip, now); !ok {
+		writeLockedOut(w, until, now)
+		return false
+	}
+	ok, err := reserveAccountAttempt(userID, ip, now)
+	if err != nil {
+		log.Printf("Error counting password attempt: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return false
+	}
+	if !ok {
+		http.Error(w, "too many failed attempts, try again later", http.StatusTooManyRequests)
+		return false
+	}
+	return true
+}
+
+// forgivePasswordCheck forgets a password check counted by
+// reservePasswordCheck, once it has passed.
+func forgivePasswordCheck(userID int, ip string) {
+	loginIPs.succeed(ip)
+	if err := resetAccountFailures(userID, ip); err != nil {
+		log.Printf("Error resetting failed logins: %v", err)
+	}
+}
+
+// newLoginToken returns the token for the TOTP step of a user's login.
+func newLoginToken(userID int, now time.Time) (string, error) {
+	token, err := newToken()
+	if err != nil {
+		return "", err
+	}
+	now = now.Truncate(time.Second)
+	_, err = db.Exec(
+		"INSERT INTO login_challenges (token_hash, user_id, attempts, expires_at) VALUES (?, ?, 0, ?)",
+		hashToken(token), userID, now.Add(loginTokenLifetime),
+	)
+	if err != nil {
+		return "", fmt.Errorf("insert login challenge: %w", err)
+	}
+	return token, nil
+}
+
+// claimLoginAttempt uses up one of a login token's attempts and returns the
+// user it was issued to. It returns false if the token is unknown, expired or
+// out of attempts.
+func claimLoginAttempt(token string, now time.Time) (int, bool, error) {
+	res, err := db.Exec(
+		"UPDATE login_challenges SET attempts = attempts + 1 WHERE token_hash = ? AND expires_at > ? AND attempts < ?",
+		hashToken(token), now, loginTokenMaxAttempts,
+	)
+	if err != nil {
+		return 0, false, fmt.Errorf("claim login attempt: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return 0, false, nil
+	}
+	var userID int
+	err = db.QueryRow("SELECT user_id FROM login_challenges WHERE token_hash = ?", hashToken(token)).Scan(&userID)
+	if err == sql.ErrNoRows {
+		// Used up by a concurrent successful attempt
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("select login challenge: %w", err)
+	}
+	return userID, true, nil
+}
+
+// deleteExpiredLoginChallenges removes login tokens past their expiry. It is
+// run by the retention job.
+func deleteExpiredLoginChallenges(now time.Time) error {
+	if _, err := db.Exec("DELETE FROM login_challenges WHERE expires_at <= ?", now.UTC()); err != nil {
+		return fmt.Errorf("delete expired login challenges: %w", err)
+	}
+	return nil
+}
+
+// handleLoginTOTP is the second step of logging in to an account with TOTP
+// enabled. It takes the loginToken handleLogin responded with, and a code
+// from the user's authenticator app or a recovery code, and starts the
+// session. Wrong codes count towards the lockouts in lockout.go, and use up
+// one of the token's attempts.
+// Expects POST JSON body: { "loginToken": "<token>", "code": "<code>" }
+func handleLoginTOTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		LoginToken string `json:"loginToken"`
+		Code       string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.LoginToken == "" || req.Code == "" {
+		http.Error(w, "loginToken and code required", http.StatusBadRequest)
+		return
+	}
+
+	// A locked out IP retrying mustn't use up the token's attempts
+	now := time.Now().UTC()
+	ip := clientIP(r)
+	if until, ok := loginIPs.reserve(ip, now); !ok {
+		writeLockedOut(w, until, now)
+		return
+	}
+	userID, ok, err := claimLoginAttempt(req.LoginToken, now)
+	if err != nil {
+		log.Printf("Error checking login token: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "login expired, please log in again", http.StatusUnauthorized)
+		return
+	}
+	var user User
+	var username sql.NullString
+	err = db.QueryRow(
+		"SELECT user_id, email, username, email_verified, totp_enabled FROM users WHERE user_id = ?",
+		userID,
+	).Scan(&user.UserID, &user.Email, &username, &user.EmailVerified, &user.TOTPEnabled)
+	if err != nil {
+		log.Printf("Error looking up user: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	user.Username = username.String
+	if !user.TOTPEnabled {
+		// Disabled since the password step
+		http.Error(w, "login expired, please log in again", http.StatusUnauthorized)
+		return
+	}
+
+	ok, err = reserveAccountAttempt(userID, ip, now)
+	if err != nil {
+		log.Printf("Error counting login attempt: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "invalid code", http.StatusUnauthorized)
+		return
+	}
+	ok, err = checkSecondFactor(userID, req.Code, now)
+	if err != nil {
+		log.Printf("Error checking second factor: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "invalid code", http.StatusUnauthorized)
+		return
+	}
+	loginIPs.succeed(ip)
+	if err := resetAccountFailures(userID, ip); err != nil {
+		log.Printf("Error resetting failed logins: %v", err)
+	}
+	if _, err := db.Exec("DELETE FROM login_challenges WHERE token_hash = ?", hashToken(req.LoginToken)); err != nil {
+		log.Printf("Error deleting login challenge: %v", err)
+	}
+
+	if err := setSessionCookie(w, r, userID); err != nil {
+		log.Printf("Error starting session: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(user)
+}
+
+// handleEnrollTOTP starts setting up TOTP for the logged in user. It
+// generates a secret and responds with it and its provisioning URI:
+// { "secret": "<base32>", "provisioningUri": "otpauth://..." }
+// TOTP isn't enabled until a code from the app is confirmed with
+// handleActivateTOTP. Enrolling again replaces a secret not yet activated.
+// Expects POST JSON body: { "password": "<current password>" }
+func handleEnrollTOTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, ok := getSessionUserID(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	ip, now := clientIP(r), time.Now().UTC()
+	if !reservePasswordCheck(w, userID, ip, now) {
+		return
+	}
+	ok, err := checkUserPassword(userID, req.Password)
+	if err != nil {
+		log.Printf("Error checking password: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "invalid password", http.StatusForbidden)
+		return
+	}
+	forgivePasswordCheck(userID, ip)
+
+	var email string
+	var enabled bool
+	if err := db.QueryRow("SELECT email, totp_enabled FROM users WHERE user_id = ?", userID).Scan(&email, &enabled); err != nil {
+		log.Printf("Error looking up user: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if enabled {
+		http.Error(w, "two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+
+	key := make([]byte, totpSecretSize)
+	if _, err := rand.Read(key); err != nil {
+		log.Printf("Error generating TOTP secret: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	secret := totpEncoding.EncodeToString(key)
+	if _, err := db.Exec("UPDATE users SET totp_pending_secret = ? WHERE user_id = ?", secret, userID); err != nil {
+		log.Printf("Error storing TOTP secret: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"secret":          secret,
+		"provisioningUri": totpProvisioningURI(secret, email),
+	})
+}
+
+// handleActivateTOTP enables TOTP for the logged in user once they have
+// entered a code from the secret handleEnrollTOTP gave them. It responds with
+// their recovery codes, which are only shown this once:
+// { "recoveryCodes": ["abcde-fghij", ...] }
+// Expects POST JSON body: { "code": "<code>" }
+func handleActivateTOTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, ok := getSessionUserID(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var pending sql.NullString
+	if err := tx.QueryRow("SELECT totp_pending_secret FROM users WHERE user_id = ? FOR UPDATE", userID).Scan(&pending); err != nil {
+		log.Printf("Error looking up TOTP secret: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if !pending.Valid {
+		http.Error(w, "no two-factor enrollment in progress", http.StatusConflict)
+		return
+	}
+	step, ok := matchTOTP(pending.String, strings.TrimSpace(req.Code), time.Now().UTC())
+	if !ok {
+		http.Error(w, "invalid code", http.StatusBadRequest)
+		return
+	}
+
+	_, err = tx.Exec(
+		"UPDATE users SET totp_secret = ?, totp_enabled = 1, totp_pending_secret = NULL, totp_last_step = ? WHERE user_id = ?",
+		pending.String, step, userID,
+	)
+	if err != nil {
+		log.Printf("Error enabling TOTP: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	codes, err := replaceRecoveryCodes(tx, userID)
+	if err != nil {
+		log.Printf("Error creating recovery codes: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing TOTP activation: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]string{"recoveryCodes": codes})
+}
+
+// handleDisableTOTP turns TOTP off for the logged in user.
+// Expects POST JSON body: { "password": "<current password>", "code": "<code or recovery code>" }
+func handleDisableTOTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, ok := getSessionUserID(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	var enabled bool
+	if err := db.QueryRow("SELECT totp_enabled FROM users WHERE user_id = ?", userID).Scan(&enabled); err != nil {
+		log.Printf("Error looking up user: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if !enabled {
+		http.Error(w, "two-factor authentication is not enabled", http.StatusConflict)
+		return
+	}
+
+	// The attempt is only forgiven once the code has passed too
+	ip, now := clientIP(r), time.Now().UTC()
+	if !reservePasswordCheck(w, userID, ip, now) {
+		return
+	}
+	ok, err := checkUserPassword(userID, req.Password)
+	if err != nil {
+		log.Printf("Error checking password: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "invalid password", http.StatusForbidden)
+		return
+	}
+	ok, err = checkSecondFactor(userID, req.Code, now)
+	if err != nil {
+		log.Printf("Error checking second factor: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "invalid code", http.StatusForbidden)
+		return
+	}
+	forgivePasswordCheck(userID, ip)
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(
+		"UPDATE users SET totp_secret = NULL, totp_enabled = 0, totp_pending_secret = NULL, totp_last_step = NULL WHERE user_id = ?",
+		userID,
+	)
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM totp_recovery_codes WHERE user_id = ?", userID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("Error disabling TOTP: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
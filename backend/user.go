@@ -7,7 +7,6 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
-	"slices"
 	"time"
 )
 
@@ -24,7 +23,7 @@ func handleGetAllMyPlants(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Query plants for the user. Return plantName and type to match frontend usage.
-	rows, err := db.Query("SELECT plant_name, plant_id, plant_type FROM plants WHERE user_id = ?", userID)
+	rows, err := db.Query("SELECT plant_name, plant_id, plant_type, last_seen_at FROM plants WHERE user_id = ?", userID)
 	if err != nil {
 		log.Printf("Error querying plants: %v", err)
 		http.Error(w, "server error", http.StatusInternalServerError)
@@ -36,6 +35,10 @@ func handleGetAllMyPlants(w http.ResponseWriter, r *http.Request) {
 		PlantName string `json:"plantName"`
 		PlantID   string `json:"plantID"`
 		Type      string `json:"type"`
+		// LastSeen is when the plant last made an authenticated request,
+		// omitted if it never has.
+		LastSeen *time.Time `json:"lastSeen,omitempty"`
+		Online   bool       `json:"online"`
 	}
 
 	var plants []Plant
@@ -43,7 +46,8 @@ func handleGetAllMyPlants(w http.ResponseWriter, r *http.Request) {
 		var pname sql.NullString
 		var ptype sql.NullString
 		var pid sql.NullString
-		if err := rows.Scan(&pname, &pid, &ptype); err != nil {
+		var lastSeen sql.NullString
+		if err := rows.Scan(&pname, &pid, &ptype, &lastSeen); err != nil {
 			log.Printf("Error scanning plant row: %v", err)
 			http.Error(w, "server error", http.StatusInternalServerError)
 			return
@@ -58,6 +62,10 @@ func handleGetAllMyPlants(w http.ResponseWriter, r *http.Request) {
 		if pid.Valid {
 			p.PlantID = pid.String
 		}
+		if p.LastSeen, err = parseNullDBTime(lastSeen); err != nil {
+			log.Printf("Error parsing last seen time: %v", err)
+		}
+		p.Online = plantOnline(p.PlantID, p.LastSeen)
 		plants = append(plants, p)
 	}
 
@@ -126,12 +134,14 @@ func handleAddPlant(w http.ResponseWriter, r *http.Request) {
 
 // Request body for issuing a command to a plant
 type issueCommandRequest struct {
-	PlantID string `json:"plantId"`
-	Command string `json:"command"`
+	PlantID string  `json:"plantId"`
+	Command Command `json:"command"`
 }
 
 // handleIssueCommand allows an authenticated user to enqueue a command for one of their plants.
-// Expects POST JSON body: { "plantId": "<id>", "command": "<string>" }
+// Expects POST JSON body: { "plantId": "<id>", "command": { "name": "<name>", "args": { ... } } }
+// The command is validated against the catalog for the plant's type. A bare
+// command name string is also accepted and uses the default arguments.
 func handleIssueCommand(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
@@ -155,47 +165,181 @@ func handleIssueCommand(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Verify ownership
-	var plantOwnerID int
-	err := db.QueryRow("SELECT user_id FROM plants WHERE plant_id = ?", req.PlantID).Scan(&plantOwnerID)
-	if err == sql.ErrNoRows {
-		http.Error(w, "plant not found", http.StatusNotFound)
+	if !verifyPlantOwnership(w, userID, req.PlantID) {
 		return
-	} else if err != nil {
-		log.Printf("Error checking plant ownership: %v", err)
+	}
+
+	plantType, err := getPlantType(req.PlantID)
+	if err != nil {
+		log.Printf("Error getting plant type: %v", err)
 		http.Error(w, "server error", http.StatusInternalServerError)
 		return
 	}
 
-	if plantOwnerID != userID {
-		http.Error(w, "you do not own this plant", http.StatusForbidden)
+	command, err := validateCommand(plantType, req.Command)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// Enqueue command
-	if pendingCommands == nil {
-		pendingCommands = make(map[string][]string)
+	cmd, err := issueCommand(req.PlantID, command)
+	if err != nil {
+		log.Printf("Error issuing command: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
 	}
-	// Check that the plantID key exists in the pendingCommands map
-	if _, exists := pendingCommands[req.PlantID]; !exists {
-		pendingCommands[req.PlantID] = []string{}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": cmd.Status, "commandId": cmd.CommandID})
+}
+
+// handleGetCommandStatus lets an authenticated user see the delivery status of
+// the most recent commands issued to one of their plants.
+// Expects GET with query parameter plantId.
+func handleGetCommandStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
 	}
 
-	pendingCommands[req.PlantID] = append(pendingCommands[req.PlantID], req.Command)
+	userID, ok := getSessionUserID(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
 
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(map[string]string{"status": "queued"})
+	plantID := r.URL.Query().Get("plantId")
+	if plantID == "" {
+		http.Error(w, "plantId is required", http.StatusBadRequest)
+		return
+	}
+
+	if !verifyPlantOwnership(w, userID, plantID) {
+		return
+	}
+
+	cmds, err := listCommands(plantID, 50)
+	if err != nil {
+		log.Printf("Error listing commands: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cmds)
+}
+
+// handleGetAvailableCommands lists the commands (and their arguments) that one
+// of the user's plants accepts, based on its plant type.
+// Expects GET with query parameter plantId.
+func handleGetAvailableCommands(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, ok := getSessionUserID(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	plantID := r.URL.Query().Get("plantId")
+	if plantID == "" {
+		http.Error(w, "plantId is required", http.StatusBadRequest)
+		return
+	}
+
+	if !verifyPlantOwnership(w, userID, plantID) {
+		return
+	}
+
+	plantType, err := getPlantType(plantID)
+	if err != nil {
+		log.Printf("Error getting plant type: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(commandsForPlantType(plantType))
+}
+
+// getPlantType returns the plant_type of a plant, or "" if it has none.
+func getPlantType(plantID string) (string, error) {
+	var plantType sql.NullString
+	err := db.QueryRow("SELECT plant_type FROM plants WHERE plant_id = ?", plantID).Scan(&plantType)
+	if err != nil {
+		return "", err
+	}
+	return plantType.String, nil
+}
+
+// plantOwner is who to notify about a plant.
+type plantOwner struct {
+	UserID        int
+	Email         string
+	EmailVerified bool
+	Username      string
+	PlantName     string
+	PlantType     string
+}
+
+// getPlantOwner returns the owner of a plant. It returns sql.ErrNoRows if the
+// plant doesn't exist or has no owner. PlantName falls back to the plant ID
+// if the plant hasn't been named.
+func getPlantOwner(plantID string) (plantOwner, error) {
+	var o plantOwner
+	var username, name, plantType sql.NullString
+	err := db.QueryRow(
+		`SELECT u.user_id, u.email, u.email_verified, u.username, p.plant_name, p.plant_type
+		 FROM users u JOIN plants p ON p.user_id = u.user_id WHERE p.plant_id = ?`,
+		plantID,
+	).Scan(&o.UserID, &o.Email, &o.EmailVerified, &username, &name, &plantType)
+	o.Username, o.PlantName, o.PlantType = username.String, name.String, plantType.String
+	if o.PlantName == "" {
+		o.PlantName = plantID
+	}
+	return o, err
+}
+
+// verifyPlantOwnership checks that the plant exists and belongs to userID.
+// If not, it writes an error response and returns false.
+func verifyPlantOwnership(w http.ResponseWriter, userID int, plantID string) bool {
+	var plantOwnerID sql.NullInt64
+	err := db.QueryRow("SELECT user_id FROM plants WHERE plant_id = ?", plantID).Scan(&plantOwnerID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "plant not found", http.StatusNotFound)
+		return false
+	} else if err != nil {
+		log.Printf("Error checking plant ownership: %v", err)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return false
+	}
+
+	if !plantOwnerID.Valid || int(plantOwnerID.Int64) != userID {
+		http.Error(w, "you do not own this plant", http.StatusForbidden)
+		return false
+	}
+	return true
 }
 
 type PlantLogsRequest struct {
 	PlantID   string    `json:"plantID"`
 	StartDate time.Time `json:"startDate"`
 	EndDate   time.Time `json:"endDate"`
+	Bucket    string    `json:"bucket"`
 }
 
+// PlantLogEntry is a single reading, or when logs are bucketed, the summary
+// of a bucket: Val is then the average, Time the start of the bucket, and
+// Min, Max and Count describe the readings in it.
 type PlantLogEntry struct {
-	Val  float64   `json:"val"`
-	Time time.Time `json:"time"`
+	Val   float64   `json:"val"`
+	Time  time.Time `json:"time"`
+	Min   *float64  `json:"min,omitempty"`
+	Max   *float64  `json:"max,omitempty"`
+	Count int       `json:"count,omitempty"`
 }
 
 // handleGetPlantLogs retrieves sensor logs for a specific plant within a date range.
@@ -206,8 +350,15 @@ type PlantLogEntry struct {
 //	{
 //	    "plantID": "string",      // ID of the plant to get logs for
 //	    "startDate": "time",      // Start of date range (RFC3339 format)
-//	    "endDate": "time"         // End of date range (RFC3339 format)
+//	    "endDate": "time",        // End of date range (RFC3339 format)
+//	    "bucket": "string"        // Optional: "auto" (default), "raw", "5m", "15m", "1h", "6h" or "1d"
 //	}
+//
+// With "auto", short ranges are returned raw and longer ones are bucketed so
+// each sensor type has at most maxAutoPoints entries. The bucket used is
+// returned in the X-Potbot-Bucket header. Readings older than the raw
+// retention period only exist as hourly or daily summaries, so those are
+// returned as summary entries whatever the bucket.
 func handleGetPlantLogs(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
@@ -234,65 +385,27 @@ func handleGetPlantLogs(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Check if the user owns the plant
-	var plantOwnerID int
-	err := db.QueryRow("SELECT user_id FROM plants WHERE plant_id = ?", req.PlantID).Scan(&plantOwnerID)
-	if err == sql.ErrNoRows {
-		http.Error(w, "plant not found", http.StatusNotFound)
-		return
-	} else if err != nil {
-		log.Printf("Error checking plant ownership: %v", err)
-		http.Error(w, "server error", http.StatusInternalServerError)
+	bucket, bucketName, err := chooseLogBucket(req.Bucket, req.StartDate, req.EndDate)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	if plantOwnerID != userID {
-		http.Error(w, "you do not own this plant", http.StatusForbidden)
+	// Check if the user owns the plant
+	if !verifyPlantOwnership(w, userID, req.PlantID) {
 		return
 	}
 
-	// Query plant logs for the specified date range
-	rows, err := db.Query(
-		"SELECT log_type, log_value, log_time FROM plant_logs WHERE plant_id = ? AND log_time BETWEEN ? AND ? ORDER BY log_time DESC",
-		req.PlantID, req.StartDate, req.EndDate,
-	)
-	if err != nil {
+	// Query plant logs for the specified date range, from whichever
+	// retention tiers cover it
+	agg := newLogAggregator(bucket)
+	if err := loadPlantLogs(req.PlantID, req.StartDate, req.EndDate, agg); err != nil {
 		log.Printf("Error querying plant logs: %v", err)
 		http.Error(w, "server error", http.StatusInternalServerError)
 		return
 	}
-	defer rows.Close()
-
-	result := map[string][]PlantLogEntry{}
-	for _, t := range validLogTypes {
-		result[t] = make([]PlantLogEntry, 0)
-	}
-
-	for rows.Next() {
-		var logEntry PlantLogEntry
-
-		var logTimeStr string
-
-		var type_ string
-		if err := rows.Scan(&type_, &logEntry.Val, &logTimeStr); err != nil {
-			log.Printf("Error scanning plant log row: %v", err)
-			http.Error(w, "server error", http.StatusInternalServerError)
-			return
-		}
-		logEntry.Time, err = time.Parse("2006-01-02 15:04:05", logTimeStr)
-		if err != nil {
-			log.Printf("Unable to parse time string: %s", logTimeStr)
-			continue
-		}
-
-		if !slices.Contains(validLogTypes, type_) {
-			log.Printf("Unknown log type in database: %v", type_)
-			continue
-		}
-
-		result[type_] = append(result[type_], logEntry)
-	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(result)
+	w.Header().Set("X-Potbot-Bucket", bucketName)
+	json.NewEncoder(w).Encode(agg.result())
 }
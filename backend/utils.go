@@ -8,9 +8,8 @@ import (
 	"log"
 	"math/rand"
 	"net/http"
-	"net/smtp"
 	"os"
-	"strings"
+	"time"
 
 	"golang.org/x/crypto/bcrypt"
 )
@@ -70,32 +69,45 @@ func handlePing(w http.ResponseWriter, r *http.Request) {
 
 // sendEmail sends a simple plain-text email using SMTP server config from the `.env` file.
 func sendEmail(to, subject, body string) error {
-	from := os.Getenv("POTBOT_EMAIL_ADDRESS")
-	pass := os.Getenv("POTBOT_EMAIL_PASSWORD")
-	mailServer := os.Getenv("POTBOT_MAIL_SERVER")
-	mailPort := os.Getenv("POTBOT_MAIL_PORT")
-
-	if from == "" || pass == "" || mailServer == "" || mailPort == "" {
-		return fmt.Errorf("email configuration not set in environment")
-	}
+	return smtpConfigFromEnv().send(to, subject, body, "")
+}
 
-	auth := smtp.PlainAuth("", from, pass, mailServer)
+// dbTimeLayout is the format MySQL DATETIME columns are returned in. The DSN
+// doesn't set parseTime, so they come back as strings.
+const dbTimeLayout = "2006-01-02 15:04:05"
 
-	headers := map[string]string{
-		"From":         from,
-		"To":           to,
-		"Subject":      subject,
-		"MIME-Version": "1.0",
-		"Content-Type": "text/plain; charset=\"utf-8\"",
+// parseDBTime parses a DATETIME column value returned as a string.
+func parseDBTime(s string) (time.Time, error) {
+	t, err := time.Parse(dbTimeLayout, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("parse db time %q: %w", s, err)
 	}
+	return t, nil
+}
 
-	var msg strings.Builder
-	for k, v := range headers {
-		msg.WriteString(fmt.Sprintf("%s: %s\r\n", k, v))
+// parseNullDBTime parses a nullable DATETIME column value, returning nil for NULL.
+func parseNullDBTime(ns sql.NullString) (*time.Time, error) {
+	if !ns.Valid {
+		return nil, nil
 	}
-	msg.WriteString("\r\n")
-	msg.WriteString(body)
+	t, err := parseDBTime(ns.String)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
 
-	addr := mailServer + ":" + mailPort
-	return smtp.SendMail(addr, auth, from, []string{to}, []byte(msg.String()))
+// envDuration reads a duration such as "5m" or "168h" from the environment,
+// falling back to def if it is unset or invalid.
+func envDuration(key string, def time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Printf("invalid duration %q for %s, using %v", v, key, def)
+		return def
+	}
+	return d
 }
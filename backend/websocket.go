@@ -0,0 +1,265 @@
+// `websocket.go` contains the WebSocket channel plants can keep open to get
+// commands the instant they're issued and to stream readings back
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	wsWriteWait  = 10 * time.Second
+	wsPongWait   = 60 * time.Second
+	wsPingPeriod = 30 * time.Second // must be less than wsPongWait
+	wsMaxMessage = 4096
+)
+
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// wsMessage is the envelope of every message sent over a plant's socket.
+//
+// Server to plant:
+//
+//	{ "type": "command", "command": <PlantCommand> }
+//	{ "type": "error", "error": "<reason>" }
+//
+// Plant to server:
+//
+//	{ "type": "log", "logType": "<type>", "logValue": <number>, "timestamp": <optional>, "sentAt": <optional> }
+//	{ "type": "ack", "commandId": <id>, "success": <bool>, "message": "<optional>" }
+type wsMessage struct {
+	Type string `json:"type"`
+
+	Command *PlantCommand `json:"command,omitempty"`
+	Error   string        `json:"error,omitempty"`
+
+	LogType   string           `json:"logType,omitempty"`
+	LogValue  float64          `json:"logValue,omitempty"`
+	Timestamp *deviceTimestamp `json:"timestamp,omitempty"`
+	SentAt    *deviceTimestamp `json:"sentAt,omitempty"`
+
+	CommandID int64  `json:"commandId,omitempty"`
+	Success   bool   `json:"success,omitempty"`
+	Message   string `json:"message,omitempty"`
+}
+
+// deviceConn is a connected plant. All writes go through send so that only
+// the writer goroutine touches the socket.
+type deviceConn struct {
+	plantID string
+	conn    *websocket.Conn
+	send    chan wsMessage
+	done    chan struct{}
+	once    sync.Once
+}
+
+func (d *deviceConn) close() {
+	d.once.Do(func() {
+		close(d.done)
+		d.conn.Close()
+	})
+}
+
+// queue hands a message to the writer goroutine, returning false if the
+// connection is closed or too far behind.
+func (d *deviceConn) queue(m wsMessage) bool {
+	select {
+	case <-d.done:
+		return false
+	case d.send <- m:
+		return true
+	default:
+		return false
+	}
+}
+
+// deviceHub tracks which plants currently have a socket open.
+type deviceHub struct {
+	mu    sync.Mutex
+	conns map[string]*deviceConn
+}
+
+var devices = &deviceHub{conns: make(map[string]*deviceConn)}
+
+// register makes d the plant's connection, closing any older one.
+func (h *deviceHub) register(d *deviceConn) {
+	h.mu.Lock()
+	old := h.conns[d.plantID]
+	h.conns[d.plantID] = d
+	h.mu.Unlock()
+	if old != nil {
+		old.close()
+	}
+}
+
+func (h *deviceHub) unregister(d *deviceConn) {
+	h.mu.Lock()
+	if h.conns[d.plantID] == d {
+		delete(h.conns, d.plantID)
+	}
+	h.mu.Unlock()
+}
+
+func (h *deviceHub) get(plantID string) *deviceConn {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.conns[plantID]
+}
+
+func (h *deviceHub) online(plantID string) bool {
+	return h.get(plantID) != nil
+}
+
+// pushQueuedCommands delivers a plant's pending commands over its socket if it
+// is connected. Commands pushed this way are marked delivered with an ack
+// deadline, so if the push is lost they fall back to redelivery through the
+// queue like any other unacknowledged command.
+func pushQueuedCommands(plantID string) {
+	d := devices.get(plantID)
+	if d == nil {
+		return
+	}
+	cmds, err := takeQueuedCommands(plantID, true)
+	if err != nil {
+		log.Printf("websocket: error taking commands for %s: %v", plantID, err)
+		return
+	}
+	for i := range cmds {
+		if !d.queue(wsMessage{Type: "command", Command: &cmds[i]}) {
+			log.Printf("websocket: could not push command %d to %s", cmds[i].CommandID, plantID)
+		}
+	}
+}
+
+// handlePlantWebSocket upgrades an authenticated plant's request to a
+// WebSocket. See wsMessage for the messages exchanged over it.
+func handlePlantWebSocket(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ok, plantID := verifyPlantCreds(w, r)
+	if !ok {
+		return
+	}
+
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade has already written an error response
+		log.Printf("websocket: upgrade failed for %s: %v", plantID, err)
+		return
+	}
+
+	d := &deviceConn{
+		plantID: plantID,
+		conn:    conn,
+		send:    make(chan wsMessage, 16),
+		done:    make(chan struct{}),
+	}
+	devices.register(d)
+	log.Printf("websocket: %s connected", plantID)
+
+	go d.writeLoop()
+	pushQueuedCommands(plantID)
+	d.readLoop()
+
+	devices.unregister(d)
+	d.close()
+	log.Printf("websocket: %s disconnected", plantID)
+}
+
+func (d *deviceConn) writeLoop() {
+	ticker := time.NewTicker(wsPingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.done:
+			return
+		case m := <-d.send:
+			d.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := d.conn.WriteJSON(m); err != nil {
+				d.close()
+				return
+			}
+		case <-ticker.C:
+			d.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := d.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				d.close()
+				return
+			}
+			// pick up any commands that are due for redelivery
+			go pushQueuedCommands(d.plantID)
+		}
+	}
+}
+
+func (d *deviceConn) readLoop() {
+	d.conn.SetReadLimit(wsMaxMessage)
+	d.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	d.conn.SetPongHandler(func(string) error {
+		d.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		markPlantSeen(d.plantID)
+		return nil
+	})
+
+	for {
+		_, data, err := d.conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.Printf("websocket: read error from %s: %v", d.plantID, err)
+			}
+			return
+		}
+		d.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		markPlantSeen(d.plantID)
+
+		var m wsMessage
+		if err := json.Unmarshal(data, &m); err != nil {
+			d.queue(wsMessage{Type: "error", Error: "invalid message"})
+			continue
+		}
+		d.handleMessage(m)
+	}
+}
+
+func (d *deviceConn) handleMessage(m wsMessage) {
+	switch m.Type {
+	case "log":
+		// Same timestamp rules as handlePlantLog
+		logTime, err := resolveLogTime(m.Timestamp, m.SentAt, time.Now())
+		if err != nil {
+			d.queue(wsMessage{Type: "error", Error: err.Error()})
+			return
+		}
+		err = insertPlantLog(d.plantID, m.LogType, m.LogValue, logTime)
+		if isLogValidationError(err) {
+			d.queue(wsMessage{Type: "error", Error: err.Error()})
+		} else if err != nil {
+			log.Printf("websocket: error inserting plant log: %v", err)
+			d.queue(wsMessage{Type: "error", Error: "server error"})
+		}
+	case "ack":
+		if len(m.Message) > 500 {
+			d.queue(wsMessage{Type: "error", Error: "message is too long"})
+			return
+		}
+		err := acknowledgeCommand(d.plantID, m.CommandID, m.Success, m.Message)
+		if err == errCommandNotFound || err == errCommandAlreadyAcked || err == errCommandExpired || err == errCommandNotDelivered {
+			d.queue(wsMessage{Type: "error", Error: err.Error()})
+		} else if err != nil {
+			log.Printf("websocket: error acknowledging command: %v", err)
+			d.queue(wsMessage{Type: "error", Error: "server error"})
+		}
+	default:
+		d.queue(wsMessage{Type: "error", Error: "unknown message type"})
+	}
+}
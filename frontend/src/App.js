@@ -2,9 +2,11 @@ import React, { useEffect, useState } from 'react'
 import Landing from './Landing'
 import AddPlant from './AddPlant'
 import PlantDetails from './PlantDetails'
+import Notifications from './Notifications'
+import Security from './Security'
 
 
-function Navbar({ user, onLogout, onNavigate }) {
+function Navbar({ user, unread, onLogout, onNavigate }) {
   return (
     <div className="nav">
       <div>
@@ -14,6 +16,12 @@ function Navbar({ user, onLogout, onNavigate }) {
         <span style={{ marginRight: 12 }}></span>
         <a href="#" onClick={(e) => { e.preventDefault(); onNavigate && onNavigate('add') }}>Add a new plant</a>
         <span style={{ marginRight: 12 }}></span>
+        <a href="#" onClick={(e) => { e.preventDefault(); onNavigate && onNavigate('notifications') }}>
+          Notifications{unread > 0 ? ` (${unread})` : ''}
+        </a>
+        <span style={{ marginRight: 12 }}></span>
+        <a href="#" onClick={(e) => { e.preventDefault(); onNavigate && onNavigate('security') }}>Security</a>
+        <span style={{ marginRight: 12 }}></span>
         <a href="#" onClick={(e) => { e.preventDefault(); onLogout() }}>Logout</a>
       </div>
     </div>
@@ -27,6 +35,8 @@ function App() {
   const [view, setView] = useState('home')
   const [plants, setPlants] = useState(null)
   const [selectedPlant, setSelectedPlant] = useState(null)
+  const [unread, setUnread] = useState(0)
+  const [notice, setNotice] = useState(null)
 
   function setUser(u) {
     // update React state and persist minimal user info locally
@@ -54,8 +64,26 @@ function App() {
       // ignore
     }
 
+    // confirm the email address first if opened from a verification link, so
+    // the user fetched below is up to date
+    const verifyToken = new URLSearchParams(window.location.search).get('verify_token')
+    const confirmed = verifyToken
+      ? fetch('/api/confirm_email', {
+          method: 'POST',
+          headers: { 'Content-Type': 'application/json' },
+          credentials: 'include',
+          body: JSON.stringify({ token: verifyToken })
+        })
+          .then(res => {
+            setNotice(res.ok ? 'Your email address has been verified.' : 'This verification link is invalid or has expired.')
+            window.history.replaceState(null, '', window.location.pathname)
+          })
+          .catch(() => setNotice('Could not verify your email address. Please try again.'))
+      : Promise.resolve()
+
     // then verify the session with the server and correct state if needed
-    fetch('/api/me', { credentials: 'include' })
+    confirmed
+      .then(() => fetch('/api/me', { credentials: 'include' }))
       .then(res => {
         if (!res.ok) {
           throw new Error('no session')
@@ -93,6 +121,37 @@ function App() {
       })
   }, [user, view])
 
+  // poll the unread notification count for the navbar badge
+  useEffect(() => {
+    if (!user) {
+      setUnread(0)
+      return
+    }
+
+    function refresh() {
+      fetch('/api/get_unread_notification_count', { credentials: 'include' })
+        .then(res => {
+          if (!res.ok) throw new Error('failed')
+          return res.json()
+        })
+        .then(data => setUnread(data.unread))
+        .catch(err => console.warn('could not fetch unread count', err))
+    }
+    refresh()
+    const timer = setInterval(refresh, 60000)
+    return () => clearInterval(timer)
+  }, [user])
+
+  async function resendVerification() {
+    const res = await fetch('/api/resend_verification_email', { method: 'POST', credentials: 'include' })
+    if (res.ok) {
+      setNotice(`A new verification link has been sent to ${user.email}.`)
+    } else {
+      const text = await res.text()
+      setNotice('Could not send verification email: ' + text)
+    }
+  }
+
   async function logout() {
     await fetch('/api/logout', { method: 'POST', credentials: 'include' })
     setUser(null)
@@ -105,14 +164,32 @@ function App() {
 
   if (loading) return <div className="container">Loading...</div>
 
-  if (!user) return <Landing setUser={setUser} />
+  const banner = (
+    <>
+      {notice && <div className="container"><p>{notice}</p></div>}
+      {user && !user.email_verified && (
+        <div className="container">
+          <p style={{ color: 'darkorange' }}>
+            {user.verification_email_sent === false
+              ? `We couldn't send a verification link to ${user.email}. Please ask for a new one.`
+              : `Please verify your email address (${user.email}) using the link we emailed you.`}
+            {' '}Until then, we won't email you about your plants.
+            <button style={{ marginLeft: 12 }} onClick={resendVerification}>Resend link</button>
+          </p>
+        </div>
+      )}
+    </>
+  )
+
+  if (!user) return <>{banner}<Landing setUser={setUser} /></>
 
 
   // Render plant details view
   if (view === 'details') {
     return (
       <div style={{ height: '100%' }}>
-        <Navbar user={user} onLogout={logout} onNavigate={navigate} />
+        <Navbar user={user} unread={unread} onLogout={logout} onNavigate={navigate} />
+        {banner}
         <div className="container">
           {/* <button onClick={() => { setView('home'); setSelectedPlant(null) }}>Back to home</button> */}
           {selectedPlant ? (
@@ -127,20 +204,29 @@ function App() {
 
   return (
     <div style={{ height: '100%' }}>
-      <Navbar user={user} onLogout={logout} onNavigate={navigate} />
+      <Navbar user={user} unread={unread} onLogout={logout} onNavigate={navigate} />
+      {banner}
       <div className="container">
         {view === 'add' ? (
           <AddPlant onDone={() => setView('home')} />
+        ) : view === 'notifications' ? (
+          <Notifications onUnreadChange={setUnread} />
+        ) : view === 'security' ? (
+          <Security user={user} onChange={setUser} />
         ) : (
           <>
             {plants && plants.length > 0 ? (
               <div>
                 <h3>Your plants</h3>
-                <p>To do: implement this page as a list of icons, and also show the "last connected" time of each plant.</p>
+                <p>To do: implement this page as a list of icons.</p>
                 <ul>
                   {plants.map((p, i) => (
                     <li key={i}>
                       {p.plantName} of type: {p.type}
+                      <span style={{ marginLeft: 12, color: p.online ? 'green' : 'gray' }}>
+                        {p.online ? 'online' : 'offline'}
+                        {p.lastSeen ? ` (last connected ${new Date(p.lastSeen).toLocaleString()})` : ' (never connected)'}
+                      </span>
                       <button style={{ marginLeft: 12 }} onClick={() => { setSelectedPlant(p); setView('details') }}>Details</button>
                     </li>
                   ))}
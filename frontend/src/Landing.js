@@ -1,4 +1,5 @@
 import React, { useState } from 'react'
+import PasswordReset from './PasswordReset'
 
 
 export default function Landing({ setUser }) {
@@ -8,6 +9,12 @@ export default function Landing({ setUser }) {
   const [password, setPassword] = useState("")
   const [confirmPassword, setConfirmPassword] = useState("")
   const [err, setErr] = useState(null)
+  // set when opened from an emailed password reset link
+  const [resetToken, setResetToken] = useState(() => new URLSearchParams(window.location.search).get('reset_token'))
+  const [isReset, setIsReset] = useState(false)
+  // set when the password was right and the account has two-factor auth
+  const [loginToken, setLoginToken] = useState(null)
+  const [code, setCode] = useState("")
 
   async function submit(e) {
     e.preventDefault()
@@ -37,16 +44,69 @@ export default function Landing({ setUser }) {
       setErr(text)
       return
     }
+    const data = await res.json()
+    if (data.totpRequired) {
+      setLoginToken(data.loginToken)
+      setPassword("")
+      return
+    }
+    setUser(data)
+  }
+
+  async function submitCode(e) {
+    e.preventDefault()
+    setErr(null)
+
+    const res = await fetch('/api/login_totp', {
+      method: 'POST',
+      headers: { 'Content-Type': 'application/json' },
+      credentials: 'include',
+      body: JSON.stringify({ loginToken, code })
+    })
+    if (!res.ok) {
+      const text = await res.text()
+      setErr(text)
+      if (res.status === 401 && text.includes('expired')) setLoginToken(null)
+      return
+    }
     const u = await res.json()
     setUser(u)
   }
 
+  if (loginToken) {
+    return (
+      <div className="container">
+        <h2>Two-factor authentication</h2>
+        <form className="form" onSubmit={submitCode}>
+          <input
+            placeholder="Code from your authenticator app, or a recovery code"
+            value={code}
+            onChange={e => setCode(e.target.value)}
+            autoComplete="one-time-code"
+            required
+          />
+          <div>
+            <button className="btn" type="submit">Verify</button>
+            <button className="btn" type="button" onClick={() => { setLoginToken(null); setCode(""); setErr(null) }} style={{ marginLeft: 8 }}>
+              Back to login
+            </button>
+          </div>
+          {err && <p style={{ color: 'red' }}>{err}</p>}
+        </form>
+      </div>
+    )
+  }
+
+  if (isReset || resetToken) {
+    return <PasswordReset token={resetToken} onDone={() => { setIsReset(false); setResetToken(null) }} />
+  }
+
   return (
     <div className="container">
       <h2>{isRegister ? 'Create an account' : 'Login'}</h2>
       <form className="form" onSubmit={submit}>
         <input
-          placeholder="Username"
+          placeholder={isRegister ? "Username" : "Username or email"}
           value={username}
           onChange={e => setUsername(e.target.value)}
           required
@@ -92,6 +152,11 @@ export default function Landing({ setUser }) {
           >
             {isRegister ? 'Back to login' : 'New user? Register here'}
           </button>
+          {!isRegister && (
+            <button className="btn" type="button" onClick={() => { setIsReset(true); setErr(null) }} style={{ marginLeft: 8 }}>
+              Forgot password?
+            </button>
+          )}
         </div>
         {err && <p style={{ color: 'red' }}>{err}</p>}
       </form>
@@ -0,0 +1,69 @@
+import React, { useEffect, useState } from 'react'
+
+export default function Notifications({ onUnreadChange }) {
+  const [notifications, setNotifications] = useState([])
+  const [nextBefore, setNextBefore] = useState(null)
+  const [loading, setLoading] = useState(true)
+  const [error, setError] = useState(null)
+
+  async function load(before) {
+    setLoading(true)
+    setError(null)
+    try {
+      const query = before ? `?before=${before}` : ''
+      const res = await fetch('/api/get_notifications' + query, { credentials: 'include' })
+      if (!res.ok) throw new Error(res.statusText || res.status)
+      const data = await res.json()
+      setNotifications(prev => (before ? prev.concat(data.notifications) : data.notifications))
+      setNextBefore(data.nextBefore || null)
+    } catch (err) {
+      setError('Could not load notifications: ' + err.message)
+    } finally {
+      setLoading(false)
+    }
+  }
+
+  useEffect(() => {
+    load(null)
+  }, [])
+
+  async function markRead(body) {
+    const res = await fetch('/api/mark_notifications_read', {
+      method: 'POST',
+      credentials: 'include',
+      headers: { 'Content-Type': 'application/json' },
+      body: JSON.stringify(body)
+    })
+    if (!res.ok) return
+    const data = await res.json()
+    const now = new Date().toISOString()
+    setNotifications(prev => prev.map(n => (
+      !n.readAt && (body.all || body.notificationIds.includes(n.notificationId)) ? { ...n, readAt: now } : n
+    )))
+    if (onUnreadChange) onUnreadChange(data.unread)
+  }
+
+  return (
+    <div>
+      <h3>Notifications</h3>
+      <button onClick={() => markRead({ all: true })}>Mark all as read</button>
+      {error && <p style={{ color: 'red' }}>{error}</p>}
+      {!loading && notifications.length === 0 && <p>You don't have any notifications yet.</p>}
+      <ul>
+        {notifications.map(n => (
+          <li key={n.notificationId} style={{ fontWeight: n.readAt ? 'normal' : 'bold', marginBottom: 8 }}>
+            {n.subject}
+            <span style={{ marginLeft: 12, color: 'gray' }}>
+              {new Date(n.createdAt).toLocaleString()} · {n.status}{n.suppressedReason ? ` (${n.suppressedReason})` : ''}
+            </span>
+            {!n.readAt && (
+              <button style={{ marginLeft: 12 }} onClick={() => markRead({ notificationIds: [n.notificationId] })}>Mark read</button>
+            )}
+          </li>
+        ))}
+      </ul>
+      {loading && <p>Loading...</p>}
+      {!loading && nextBefore && <button onClick={() => load(nextBefore)}>Load more</button>}
+    </div>
+  )
+}
@@ -0,0 +1,88 @@
+import React, { useState } from 'react'
+
+// PasswordReset asks for an email to send a reset link to, or, when opened
+// from that link, for the new password.
+export default function PasswordReset({ token, onDone }) {
+  const [email, setEmail] = useState("")
+  const [password, setPassword] = useState("")
+  const [confirmPassword, setConfirmPassword] = useState("")
+  const [err, setErr] = useState(null)
+  const [status, setStatus] = useState(null)
+
+  async function submit(e) {
+    e.preventDefault()
+    setErr(null)
+    setStatus(null)
+
+    if (token && password !== confirmPassword) {
+      setErr("Passwords do not match")
+      return
+    }
+
+    const url = token ? '/api/confirm_password_reset' : '/api/request_password_reset'
+    const body = token ? { token, password } : { email }
+    const res = await fetch(url, {
+      method: 'POST',
+      headers: { 'Content-Type': 'application/json' },
+      credentials: 'include',
+      body: JSON.stringify(body)
+    })
+    if (!res.ok) {
+      const text = await res.text()
+      setErr(text)
+      return
+    }
+    if (token) {
+      // drop the token from the address bar so a refresh doesn't reuse it
+      window.history.replaceState(null, '', window.location.pathname)
+      setStatus("Your password has been changed. You can now log in.")
+      setPassword("")
+      setConfirmPassword("")
+    } else {
+      const data = await res.json()
+      setStatus(data.status)
+    }
+  }
+
+  return (
+    <div className="container">
+      <h2>{token ? 'Choose a new password' : 'Reset your password'}</h2>
+      <form className="form" onSubmit={submit}>
+        {token ? (
+          <>
+            <input
+              placeholder="New Password"
+              type="password"
+              value={password}
+              onChange={e => setPassword(e.target.value)}
+              required
+            />
+            <input
+              placeholder="Confirm Password"
+              type="password"
+              value={confirmPassword}
+              onChange={e => setConfirmPassword(e.target.value)}
+              required
+            />
+          </>
+        ) : (
+          <input
+            placeholder="Email"
+            type="email"
+            value={email}
+            onChange={e => setEmail(e.target.value)}
+            required
+          />
+        )}
+        <div>
+          <button className="btn" type="submit">{token ? 'Set password' : 'Send reset link'}</button>
+          <button className="btn" type="button" onClick={onDone} style={{ marginLeft: 8 }}>
+            Back to login
+          </button>
+        </div>
+        {status && <p>{status}</p>}
+        {err && <p style={{ color: 'red' }}>{err}</p>}
+      </form>
+    </div>
+  )
+}
@@ -24,6 +24,7 @@ export default function PlantDetails({ plantID, plantName }) {
     const [loading, setLoading] = useState(false)
     const [error, setError] = useState(null)
     const [logs, setLogs] = useState(null)
+    const [commands, setCommands] = useState([])
 
     useEffect(() => {
         if (!plantID) {
@@ -60,6 +61,39 @@ export default function PlantDetails({ plantID, plantName }) {
             .finally(() => setLoading(false))
     }, [plantID, startDate, endDate])
 
+    useEffect(() => {
+        if (!plantID) return
+        fetch(`/api/get_available_commands?plantId=${encodeURIComponent(plantID)}`, { credentials: 'include' })
+            .then(res => {
+                if (!res.ok) throw new Error('failed to fetch available commands')
+                return res.json()
+            })
+            .then(data => setCommands(data || []))
+            .catch(err => {
+                console.warn(err)
+                setCommands([])
+            })
+    }, [plantID])
+
+    // Append readings to the charts as they arrive, but only when the chart
+    // range ends at (roughly) the present
+    useEffect(() => {
+        if (!plantID) return
+        if (new Date(endDate) < new Date(Date.now() - 5 * 60 * 1000)) return
+        const source = new EventSource(`/api/plant_events?plantId=${encodeURIComponent(plantID)}`, { withCredentials: true })
+        source.addEventListener('log', (e) => {
+            const ev = JSON.parse(e.data)
+            const { logType, entry } = ev.data
+            setLogs(prev => {
+                if (!prev || !prev[logType]) return prev
+                // logs are sorted newest first
+                return { ...prev, [logType]: [entry, ...prev[logType]] }
+            })
+        })
+        source.onerror = (err) => console.warn('plant event stream error', err)
+        return () => source.close()
+    }, [plantID, endDate])
+
     function issueCommand(plantID, command) {
         fetch('/api/issue_command', {
             method: 'POST',
@@ -74,11 +108,11 @@ export default function PlantDetails({ plantID, plantName }) {
         })
             .then(res => {
                 if (!res.ok) throw new Error('failed to issue command')
-                alert(`Command "${command}" issued to plant ${plantID} with name ${plantName}`)
+                alert(`Command "${command.name}" issued to plant ${plantID} with name ${plantName}`)
             })
             .catch(err => {
                 console.warn(err)
-                alert(`Could not issue command "${command}" to plant ${plantID} with name ${plantName}`)
+                alert(`Could not issue command "${command.name}" to plant ${plantID} with name ${plantName}`)
             })
     }
 
@@ -184,8 +218,10 @@ export default function PlantDetails({ plantID, plantName }) {
             <div>
                 TODO: show some stats about the data (we might want to show the mean or sum?)
             </div>
-            {/* A button to issue a "water plant" command */}
-            <button onClick={() => issueCommand(plantID, "WATER")}>Water Plant</button>
+            {/* One button per command this type of plant accepts, sent with default arguments */}
+            {commands.map(c => (
+                <button key={c.name} title={c.description} style={{ marginRight: 8 }} onClick={() => issueCommand(plantID, { name: c.name })}>{c.label}</button>
+            ))}
             {details}
         </div>
     );
@@ -0,0 +1,94 @@
+import React, { useState } from 'react'
+
+// Security lets the user turn two-factor authentication on or off.
+export default function Security({ user, onChange }) {
+  const [password, setPassword] = useState("")
+  const [code, setCode] = useState("")
+  const [enrollment, setEnrollment] = useState(null)
+  const [recoveryCodes, setRecoveryCodes] = useState(null)
+  const [err, setErr] = useState(null)
+
+  async function post(url, body) {
+    setErr(null)
+    const res = await fetch(url, {
+      method: 'POST',
+      headers: { 'Content-Type': 'application/json' },
+      credentials: 'include',
+      body: JSON.stringify(body)
+    })
+    if (!res.ok) {
+      const text = await res.text()
+      setErr(text)
+      return null
+    }
+    return res
+  }
+
+  async function enroll(e) {
+    e.preventDefault()
+    const res = await post('/api/enroll_totp', { password })
+    if (!res) return
+    setEnrollment(await res.json())
+    setPassword("")
+  }
+
+  async function activate(e) {
+    e.preventDefault()
+    const res = await post('/api/activate_totp', { code })
+    if (!res) return
+    const data = await res.json()
+    setRecoveryCodes(data.recoveryCodes)
+    setEnrollment(null)
+    setCode("")
+    onChange({ ...user, totp_enabled: true })
+  }
+
+  async function disable(e) {
+    e.preventDefault()
+    const res = await post('/api/disable_totp', { password, code })
+    if (!res) return
+    setPassword("")
+    setCode("")
+    setRecoveryCodes(null)
+    onChange({ ...user, totp_enabled: false })
+  }
+
+  return (
+    <div>
+      <h3>Two-factor authentication</h3>
+      {recoveryCodes && (
+        <div>
+          <p>
+            Two-factor authentication is on. Save these recovery codes somewhere safe. Each can be used once
+            to log in if you lose your authenticator app, and they won't be shown again.
+          </p>
+          <pre>{recoveryCodes.join('\n')}</pre>
+        </div>
+      )}
+      {user.totp_enabled ? (
+        <form className="form" onSubmit={disable}>
+          <p>To turn two-factor authentication off, enter your password and a code.</p>
+          <input placeholder="Password" type="password" value={password} onChange={e => setPassword(e.target.value)} required />
+          <input placeholder="Code or recovery code" value={code} onChange={e => setCode(e.target.value)} required />
+          <div><button className="btn" type="submit">Turn off</button></div>
+        </form>
+      ) : enrollment ? (
+        <form className="form" onSubmit={activate}>
+          <p>
+            Add this account to your authenticator app by opening <a href={enrollment.provisioningUri}>this link</a> on
+            your phone, or by entering the key <code>{enrollment.secret}</code>. Then enter the code it shows.
+          </p>
+          <input placeholder="Code" value={code} onChange={e => setCode(e.target.value)} autoComplete="one-time-code" required />
+          <div><button className="btn" type="submit">Turn on</button></div>
+        </form>
+      ) : (
+        <form className="form" onSubmit={enroll}>
+          <p>Two-factor authentication is off. Enter your password to set it up with an authenticator app.</p>
+          <input placeholder="Password" type="password" value={password} onChange={e => setPassword(e.target.value)} required />
+          <div><button className="btn" type="submit">Set up</button></div>
+        </form>
+      )}
+      {err && <p style={{ color: 'red' }}>{err}</p>}
+    </div>
+  )
+}